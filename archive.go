@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Name of the checksum manifest inside tag archives. Verify with `sha256sum -c SHA256SUMS`.
+const archiveManifestName = "SHA256SUMS"
+
+var archiveFormats = []string{"zip", "tar"}
+
+var archiveMimeTypes = map[string]string{
+	"zip": "application/zip",
+	"tar": "application/x-tar",
+}
+
+// Picks a unique name inside the archive for every asset, based on its
+// stored filename. Collisions get the start of the hash appended.
+func archiveFilenames(assets []string) (names []string) {
+	used := map[string]bool{archiveManifestName: true}
+	for _, asset := range assets {
+		name := filepath.Base(getAssetFilename(asset))
+		if name == "." || name == ".." || name == "/" || strings.HasPrefix(name, ".") {
+			name = asset + name
+		}
+		if used[name] {
+			extension := filepath.Ext(name)
+			name = strings.TrimSuffix(name, extension) + "-" + asset[:8] + extension
+		}
+		if used[name] {
+			name = asset
+		}
+		used[name] = true
+		names = append(names, name)
+	}
+	return
+}
+
+func archiveManifest(assets []string, names []string) (string, error) {
+	// Same format as sha256sum's output.
+	var manifest strings.Builder
+	for index, asset := range assets {
+		// Not every asset is named by its SHA256 anymore.
+		checksum, err := getAssetChecksum(asset, "sha256")
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", checksum, names[index])
+	}
+	return manifest.String(), nil
+}
+
+type archiveWriter interface {
+	addFile(name string, size int64, modTime time.Time, content io.Reader, compress bool) error
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (zw zipArchiveWriter) addFile(name string, size int64, modTime time.Time, content io.Reader, compress bool) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Store, Modified: modTime}
+	// Most media is already compressed, don't waste time on it.
+	if compress {
+		header.Method = zip.Deflate
+	}
+	header.SetMode(0644)
+	writer, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, content)
+	return err
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+}
+
+func (tw tarArchiveWriter) addFile(name string, size int64, modTime time.Time, content io.Reader, compress bool) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, content)
+	return err
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case "zip":
+		return zipArchiveWriter{zip.NewWriter(w)}, nil
+	case "tar":
+		return tarArchiveWriter{tar.NewWriter(w)}, nil
+	}
+	return nil, errors.New("Archive format must be zip or tar.")
+}
+
+// Streams every asset in a tag, plus a SHA256SUMS manifest, to w.
+func exportTag(w io.Writer, tag string, format string) error {
+	tag_assets, err := assets_by_tag(tag)
+	if err != nil {
+		return err
+	}
+	archive, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	names := archiveFilenames(tag_assets)
+	manifest, err := archiveManifest(tag_assets, names)
+	if err != nil {
+		return err
+	}
+	if err = archive.addFile(archiveManifestName, int64(len(manifest)), time.Now(), strings.NewReader(manifest), true); err != nil {
+		return err
+	}
+	for index, asset := range tag_assets {
+		size, err := getAssetSize(asset)
+		if err != nil {
+			return err
+		}
+		modTime, err := getAssetModTime(asset)
+		if err != nil {
+			return err
+		}
+		fd, err := openAsset(asset)
+		if err != nil {
+			return err
+		}
+		err = archive.addFile(names[index], size, modTime, fd, isTextualMimeType(getAssetMimeType(asset)))
+		fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// Splits foo.zip into foo and zip if it's an archive format we support.
+func splitArchiveName(name string) (tag string, format string, ok bool) {
+	for _, archiveFormat := range archiveFormats {
+		if strings.HasSuffix(name, "."+archiveFormat) {
+			return strings.TrimSuffix(name, "."+archiveFormat), archiveFormat, true
+		}
+	}
+	return
+}
+
+func httpTagArchive(w http.ResponseWriter, r *http.Request, tag string, format string) {
+	if has_dot(tag) || tag == "" {
+		http.Error(w, ".'s not allowed.", http.StatusBadRequest)
+		return
+	}
+	tagPath, err := getTagPath(tag)
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	if _, err = os.Stat(tagPath); err != nil {
+		http.Error(w, "No such tag found.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", archiveMimeTypes[format])
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+tag+"."+format+"\"")
+	if err = exportTag(w, tag, format); err != nil {
+		// Headers are long gone, all we can do is log it.
+		log.Print(err)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestArchiveFilenames(t *testing.T) {
+	// Without a store, filenames fall back to the asset itself.
+	assets := []string{
+		"d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26",
+		"81a039d5debf48b9eccf2bbd53aa6140627b3354e95c74a81a5d6317c81581f6",
+	}
+	names := archiveFilenames(append(assets, assets[0]))
+	if names[0] != assets[0] || names[1] != assets[1] {
+		t.Errorf("Unexpected names: %v", names)
+	}
+	if names[2] == names[0] {
+		t.Error("Duplicate names should be made unique.")
+	}
+}
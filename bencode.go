@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Just enough bencoding (BEP 3) to write .torrent files.
+// Supports int, int64, string, []byte, []interface{} and map[string]interface{}.
+func bencode(buffer *bytes.Buffer, value interface{}) error {
+	switch typed := value.(type) {
+	case int:
+		buffer.WriteString("i" + strconv.Itoa(typed) + "e")
+	case int64:
+		buffer.WriteString("i" + strconv.FormatInt(typed, 10) + "e")
+	case string:
+		buffer.WriteString(strconv.Itoa(len(typed)) + ":" + typed)
+	case []byte:
+		buffer.WriteString(strconv.Itoa(len(typed)) + ":")
+		buffer.Write(typed)
+	case []interface{}:
+		buffer.WriteString("l")
+		for _, item := range typed {
+			if err := bencode(buffer, item); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("e")
+	case map[string]interface{}:
+		// Keys must be sorted as raw strings.
+		var keys []string
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buffer.WriteString("d")
+		for _, key := range keys {
+			bencode(buffer, key)
+			if err := bencode(buffer, typed[key]); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("e")
+	default:
+		return fmt.Errorf("Unable to bencode %T", value)
+	}
+	return nil
+}
+
+func bencodeBytes(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := bencode(&buffer, value)
+	return buffer.Bytes(), err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// Unkeyed BLAKE2b (RFC 7693), since it's not in the standard library.
+
+const blake2bBlockSize = 128
+
+var blake2bIV = [8]uint64{
+	0x6a09e667f3bcc908, 0xbb67ae8584caa73b, 0x3c6ef372fe94f82b, 0xa54ff53a5f1d36f1,
+	0x510e527fade682d1, 0x9b05688c2b3e6c1f, 0x1f83d9abfb41bd6b, 0x5be0cd19137e2179,
+}
+
+var blake2bSigma = [12][16]byte{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+}
+
+type blake2bDigest struct {
+	h      [8]uint64
+	t      [2]uint64
+	buffer [blake2bBlockSize]byte
+	offset int
+	size   int
+}
+
+func newBLAKE2b(size int) hash.Hash {
+	d := &blake2bDigest{size: size}
+	d.Reset()
+	return d
+}
+
+func (d *blake2bDigest) Reset() {
+	d.h = blake2bIV
+	d.h[0] ^= 0x01010000 ^ uint64(d.size)
+	d.t = [2]uint64{}
+	d.offset = 0
+}
+
+func (d *blake2bDigest) Size() int      { return d.size }
+func (d *blake2bDigest) BlockSize() int { return blake2bBlockSize }
+
+func (d *blake2bDigest) compress(block []byte, last bool) {
+	var m [16]uint64
+	for index := range m {
+		m[index] = binary.LittleEndian.Uint64(block[index*8:])
+	}
+	var v [16]uint64
+	copy(v[:8], d.h[:])
+	copy(v[8:], blake2bIV[:])
+	v[12] ^= d.t[0]
+	v[13] ^= d.t[1]
+	if last {
+		v[14] = ^v[14]
+	}
+	g := func(a, b, c, e int, x, y uint64) {
+		v[a] = v[a] + v[b] + x
+		v[e] = bits.RotateLeft64(v[e]^v[a], -32)
+		v[c] = v[c] + v[e]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+		v[a] = v[a] + v[b] + y
+		v[e] = bits.RotateLeft64(v[e]^v[a], -16)
+		v[c] = v[c] + v[e]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+	}
+	for _, s := range blake2bSigma {
+		g(0, 4, 8, 12, m[s[0]], m[s[1]])
+		g(1, 5, 9, 13, m[s[2]], m[s[3]])
+		g(2, 6, 10, 14, m[s[4]], m[s[5]])
+		g(3, 7, 11, 15, m[s[6]], m[s[7]])
+		g(0, 5, 10, 15, m[s[8]], m[s[9]])
+		g(1, 6, 11, 12, m[s[10]], m[s[11]])
+		g(2, 7, 8, 13, m[s[12]], m[s[13]])
+		g(3, 4, 9, 14, m[s[14]], m[s[15]])
+	}
+	for index := range d.h {
+		d.h[index] ^= v[index] ^ v[index+8]
+	}
+}
+
+func (d *blake2bDigest) addToCounter(n uint64) {
+	d.t[0] += n
+	if d.t[0] < n {
+		d.t[1]++
+	}
+}
+
+func (d *blake2bDigest) Write(data []byte) (int, error) {
+	written := len(data)
+	for len(data) > 0 {
+		// The final block has to be compressed differently, so only
+		// compress a full buffer once we know more data follows it.
+		if d.offset == blake2bBlockSize {
+			d.addToCounter(blake2bBlockSize)
+			d.compress(d.buffer[:], false)
+			d.offset = 0
+		}
+		n := copy(d.buffer[d.offset:], data)
+		d.offset += n
+		data = data[n:]
+	}
+	return written, nil
+}
+
+func (d *blake2bDigest) Sum(in []byte) []byte {
+	// Work on a copy so Sum doesn't change the running state.
+	final := *d
+	final.addToCounter(uint64(final.offset))
+	for index := final.offset; index < blake2bBlockSize; index++ {
+		final.buffer[index] = 0
+	}
+	final.compress(final.buffer[:], true)
+	var out [64]byte
+	for index, word := range final.h {
+		binary.LittleEndian.PutUint64(out[index*8:], word)
+	}
+	return append(in, out[:d.size]...)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestBLAKE2b(t *testing.T) {
+	cases := []struct {
+		size     int
+		input    string
+		expected string
+	}{
+		// RFC 7693 Appendix A.
+		{64, "abc", "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{32, "", "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+	}
+	for _, c := range cases {
+		digest := newBLAKE2b(c.size)
+		digest.Write([]byte(c.input))
+		if sum := hex.EncodeToString(digest.Sum(nil)); sum != c.expected {
+			t.Errorf("BLAKE2b-%d(%q) should be %s, got %s", c.size*8, c.input, c.expected, sum)
+		}
+	}
+	// Writes split across block boundaries should match one big write.
+	input := strings.Repeat("decensor", 100)
+	whole := newBLAKE2b(32)
+	whole.Write([]byte(input))
+	split := newBLAKE2b(32)
+	split.Write([]byte(input[:128]))
+	split.Write([]byte(input[128:300]))
+	split.Write([]byte(input[300:]))
+	if hex.EncodeToString(whole.Sum(nil)) != hex.EncodeToString(split.Sum(nil)) {
+		t.Error("Split writes should hash the same as one write.")
+	}
+}
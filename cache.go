@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Assets are content addressed and can never change.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// Listing pages can change at any time, but caches can revalidate cheaply.
+const revalidateCacheControl = "public, no-cache"
+
+// Returns true if the If-None-Match header matches etag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	// If-None-Match uses weak comparison.
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Hashes everything that can change what we render without walking the
+// store. The journal's sequence number covers assets, tags and metadata.
+// Settings, trusted publishers and the replication report live outside it,
+// and the top level directories catch tags or assets removed by hand or by
+// doctor. Per asset caches like checksums and mime sniffing only ever
+// record what an asset already is, so they don't count.
+func storeState() (state string, err error) {
+	hash := sha256.New()
+	seq, err := latestJournalSeq()
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(hash, "journal %d\n", seq)
+	paths := []string{assetsDir(), tagsDir(), metadataDir(), replicationReportPath()}
+	for _, directory := range []string{settingsDir(), trustedDir()} {
+		names, err := list_directory(directory)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		for _, name := range names {
+			paths = append(paths, directory+"/"+name)
+		}
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+	for name, override := range overrideTemplates {
+		fmt.Fprintf(hash, "%s %s\n", name, override)
+	}
+	state = hex.EncodeToString(hash.Sum(nil))
+	return
+}
+
+// Sets a weak ETag for a rendered page and writes 304 Not Modified if the
+// client already has it. Returns true if there's nothing more to do.
+func httpNotModified(w http.ResponseWriter, r *http.Request) bool {
+	state, err := storeState()
+	if err != nil {
+		// We can still render the page, just without caching.
+		log.Print(err)
+		return false
+	}
+	pageHash := sha256.Sum256([]byte(state + " " + r.URL.String()))
+	etag := "W/\"" + hex.EncodeToString(pageHash[:16]) + "\""
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", revalidateCacheControl)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+func httpServeAsset(w http.ResponseWriter, r *http.Request, asset string) {
+	fd, err := openAsset(asset)
+	if os.IsNotExist(err) {
+		http.Error(w, "No such asset found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	defer fd.Close()
+	modTime, err := getAssetModTime(asset)
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	var content io.ReadSeeker = fd
+	etag := "\"" + asset + "\""
+	if hasPrecompressed(asset) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if precompressed, err := openPrecompressed(r, asset); err == nil {
+			defer precompressed.Close()
+			// A different representation needs a different strong ETag.
+			content = precompressed
+			etag = "\"" + asset + ".gz\""
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+	if mimeType := getAssetMimeType(asset); mimeType != "" {
+		w.Header().Set("Content-Type", mimeType)
+	}
+	if filename := getAssetFilename(asset); filename != asset {
+		w.Header().Set("Content-Disposition", "inline; filename=\""+filename+"\"")
+	}
+	// The SHA256 is the strongest possible ETag. ServeContent checks
+	// If-None-Match (and If-Range) against it for us.
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	http.ServeContent(w, r, asset, modTime, content)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestEtagMatches(t *testing.T) {
+	etag := "\"abc\""
+	for _, header := range []string{"\"abc\"", "W/\"abc\"", "\"xyz\", \"abc\"", "*"} {
+		if !etagMatches(header, etag) {
+			t.Errorf("%s should match %s", header, etag)
+		}
+	}
+	for _, header := range []string{"", "\"xyz\"", "abc"} {
+		if etagMatches(header, etag) {
+			t.Errorf("%s should not match %s", header, etag)
+		}
+	}
+	if !etagMatches("\"abc\"", "W/\"abc\"") {
+		t.Error("Weak ETags should match with weak comparison.")
+	}
+}
+
+func TestStoreState(t *testing.T) {
+	t.Setenv("DECENSOR_DIR", t.TempDir()+"/store")
+	if err := init_folders(); err != nil {
+		t.Fatal(err)
+	}
+	source := t.TempDir() + "/source"
+	if err := ioutil.WriteFile(source, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	asset, err := add(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := storeState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Caches don't change what we render.
+	setAssetVerifiedAt(asset, time.Now())
+	if _, err = getAssetChecksum(asset, "md5"); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged, _ := storeState(); unchanged != state {
+		t.Errorf("Caching checksums and when an asset was verified should not change the state")
+	}
+	if err = tag(asset, []string{"cachetag"}); err != nil {
+		t.Fatal(err)
+	}
+	tagged, _ := storeState()
+	if tagged == state {
+		t.Errorf("Tagging should change the state")
+	}
+	if err = setSetting("site_title", "Changed"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := storeState(); changed == tagged {
+		t.Errorf("Changing a setting should change the state")
+	}
+}
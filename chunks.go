@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The chunk store keeps assets as a recipe of content defined chunks
+// instead of a file in assetsDir(). Chunks are stored once under
+// chunksDir(), named by their SHA256, so re-encoded or edited copies of a
+// big file only cost the chunks that changed. A recipe is recipesDir()/<asset>
+// with one "<chunk SHA256> <size>" line per chunk, in order. The asset is
+// still named by the hash of the whole file, openAsset() puts it back
+// together.
+//
+// Chunk boundaries come from a gear rolling hash, so the same content is cut
+// the same way wherever it is in a file, and in every store.
+
+const chunkMinSize = 256 * 1024
+const chunkMaxSize = 4 * 1024 * 1024
+
+// Cut when the top 20 bits of the rolling hash are zero, about every
+// 1MiB after chunkMinSize.
+const chunkMask = uint64(1<<20-1) << 44
+
+// Random looking, but fixed so every store cuts the same way.
+var gearTable = func() (table [256]uint64) {
+	for index := range table {
+		sum := sha256.Sum256([]byte("decensor gear " + strconv.Itoa(index)))
+		table[index] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return
+}()
+
+type recipeChunk struct {
+	Hash string
+	Size int64
+	// Where the chunk starts in the asset.
+	Offset int64
+}
+
+func chunksDir() string {
+	return baseDir() + "/chunks"
+}
+
+func recipesDir() string {
+	return baseDir() + "/recipes"
+}
+
+func getChunkPath(chunk string) string {
+	return chunksDir() + "/" + chunk
+}
+
+func getRecipePath(asset string) string {
+	return recipesDir() + "/" + asset
+}
+
+// Encrypted stores encrypt whole assets instead.
+func chunkStoreEnabled() bool {
+	return getSettingOrDefault("chunk_store") == "on" && !storeEncrypted()
+}
+
+func isChunked(asset string) bool {
+	_, err := os.Stat(getRecipePath(asset))
+	return err == nil
+}
+
+func validateChunkHash(chunk string) error {
+	if len(chunk) != sha256.Size*2 || !isHex(chunk) {
+		return errors.New("Chunks are named by 64 hex characters.")
+	}
+	return nil
+}
+
+// Splits reader into content defined chunks.
+func splitChunks(reader io.Reader, chunk func([]byte) error) (err error) {
+	buffered := bufio.NewReaderSize(reader, 1024*1024)
+	current := make([]byte, 0, chunkMaxSize)
+	var fingerprint uint64
+	for {
+		character, readErr := buffered.ReadByte()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+		current = append(current, character)
+		fingerprint = fingerprint<<1 + gearTable[character]
+		if (len(current) >= chunkMinSize && fingerprint&chunkMask == 0) || len(current) >= chunkMaxSize {
+			if err = chunk(current); err != nil {
+				return
+			}
+			current = current[:0]
+			fingerprint = 0
+		}
+	}
+	if len(current) != 0 {
+		err = chunk(current)
+	}
+	return
+}
+
+// Stores a chunk unless we already have it. Returns true if it was new.
+func storeChunk(data []byte) (hash string, stored bool, err error) {
+	sum := sha256.Sum256(data)
+	hash = hex.EncodeToString(sum[:])
+	if _, err = os.Stat(getChunkPath(hash)); err == nil {
+		return
+	}
+	// Stores from before the chunk store existed won't have the directory.
+	if err = os.MkdirAll(chunksDir(), 0755); err != nil {
+		return
+	}
+	temporaryPath := getChunkPath(hash) + ".tmp"
+	if err = ioutil.WriteFile(temporaryPath, data, 0644); err != nil {
+		return
+	}
+	if err = os.Rename(temporaryPath, getChunkPath(hash)); err != nil {
+		return
+	}
+	stored = true
+	return
+}
+
+func formatRecipe(chunks []recipeChunk) string {
+	var recipe strings.Builder
+	for _, chunk := range chunks {
+		fmt.Fprintf(&recipe, "%s %d\n", chunk.Hash, chunk.Size)
+	}
+	return recipe.String()
+}
+
+func parseRecipe(recipe string) (chunks []recipeChunk, err error) {
+	var offset int64
+	for _, line := range strings.Split(strings.TrimRight(recipe, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("Recipe is corrupt: " + line)
+		}
+		if err = validateChunkHash(fields[0]); err != nil {
+			return
+		}
+		size, parseErr := strconv.ParseInt(fields[1], 10, 64)
+		// Recipes can come from mirrors, and chunks are read into memory.
+		if parseErr != nil || size <= 0 || size > chunkMaxSize {
+			return nil, errors.New("Recipe is corrupt: " + line)
+		}
+		chunks = append(chunks, recipeChunk{Hash: fields[0], Size: size, Offset: offset})
+		offset += size
+	}
+	return
+}
+
+func readRecipe(asset string) (chunks []recipeChunk, err error) {
+	recipeByte, err := ioutil.ReadFile(getRecipePath(asset))
+	if err != nil {
+		return
+	}
+	return parseRecipe(string(recipeByte))
+}
+
+func writeRecipe(asset string, chunks []recipeChunk) (err error) {
+	if err = os.MkdirAll(recipesDir(), 0755); err != nil {
+		return
+	}
+	temporaryPath := getRecipePath(asset) + ".tmp"
+	if err = ioutil.WriteFile(temporaryPath, []byte(formatRecipe(chunks)), 0644); err != nil {
+		return
+	}
+	return os.Rename(temporaryPath, getRecipePath(asset))
+}
+
+// Splits a file into the chunk store and writes its recipe.
+func chunkFile(asset string, path string) (err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	var chunks []recipeChunk
+	var offset int64
+	stored := 0
+	err = splitChunks(fd, func(data []byte) error {
+		hash, fresh, err := storeChunk(data)
+		if err != nil {
+			return err
+		}
+		if fresh {
+			stored++
+		}
+		chunks = append(chunks, recipeChunk{Hash: hash, Size: int64(len(data)), Offset: offset})
+		offset += int64(len(data))
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	log.Printf("%s is %d chunks, %d of them new.", asset, len(chunks), stored)
+	return writeRecipe(asset, chunks)
+}
+
+// Reads an asset back out of its chunks. Not safe for concurrent use.
+type chunkedAsset struct {
+	chunks  []recipeChunk
+	size    int64
+	offset  int64
+	current int
+	fd      *os.File
+}
+
+func newChunkedAsset(chunks []recipeChunk) *chunkedAsset {
+	reader := &chunkedAsset{chunks: chunks, current: -1}
+	if len(chunks) != 0 {
+		last := chunks[len(chunks)-1]
+		reader.size = last.Offset + last.Size
+	}
+	return reader
+}
+
+func openChunkedAsset(asset string) (reader *chunkedAsset, err error) {
+	chunks, err := readRecipe(asset)
+	if err != nil {
+		return
+	}
+	return newChunkedAsset(chunks), nil
+}
+
+func (reader *chunkedAsset) ReadAt(p []byte, offset int64) (n int, err error) {
+	for n < len(p) {
+		if offset >= reader.size {
+			return n, io.EOF
+		}
+		index := sort.Search(len(reader.chunks), func(i int) bool {
+			return reader.chunks[i].Offset+reader.chunks[i].Size > offset
+		})
+		if index != reader.current {
+			if reader.fd != nil {
+				reader.fd.Close()
+				reader.fd = nil
+			}
+			if reader.fd, err = os.Open(getChunkPath(reader.chunks[index].Hash)); err != nil {
+				return
+			}
+			reader.current = index
+		}
+		chunk := reader.chunks[index]
+		want := p[n:]
+		if remaining := chunk.Offset + chunk.Size - offset; int64(len(want)) > remaining {
+			want = want[:remaining]
+		}
+		read, readErr := reader.fd.ReadAt(want, offset-chunk.Offset)
+		n += read
+		offset += int64(read)
+		if read != len(want) {
+			if readErr == nil || readErr == io.EOF {
+				readErr = fmt.Errorf("Chunk %s is shorter than its recipe says.", chunk.Hash)
+			}
+			return n, readErr
+		}
+	}
+	return
+}
+
+func (reader *chunkedAsset) Read(p []byte) (n int, err error) {
+	n, err = reader.ReadAt(p, reader.offset)
+	reader.offset += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return
+}
+
+func (reader *chunkedAsset) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.size
+	default:
+		return 0, errors.New("Invalid whence.")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position.")
+	}
+	reader.offset = offset
+	return offset, nil
+}
+
+func (reader *chunkedAsset) Close() error {
+	if reader.fd != nil {
+		return reader.fd.Close()
+	}
+	return nil
+}
+
+// Every chunk any recipe uses, except asset's.
+func chunksInUse(except string) (inUse map[string]bool, err error) {
+	inUse = make(map[string]bool)
+	recipes, err := list_directory(recipesDir())
+	if os.IsNotExist(err) {
+		return inUse, nil
+	}
+	for _, asset := range recipes {
+		if asset == except || strings.HasSuffix(asset, ".tmp") {
+			continue
+		}
+		chunks, err := readRecipe(asset)
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			inUse[chunk.Hash] = true
+		}
+	}
+	return
+}
+
+// Removes a recipe and whichever of its chunks nothing else uses.
+func removeChunked(asset string) (err error) {
+	chunks, err := readRecipe(asset)
+	if err != nil {
+		return
+	}
+	inUse, err := chunksInUse(asset)
+	if err != nil {
+		return
+	}
+	if err = os.Remove(getRecipePath(asset)); err != nil {
+		return
+	}
+	for _, chunk := range chunks {
+		if inUse[chunk.Hash] {
+			continue
+		}
+		if err = os.Remove(getChunkPath(chunk.Hash)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		// The same chunk can be in a recipe twice.
+		inUse[chunk.Hash] = true
+	}
+	return nil
+}
+
+// Moves an asset into the chunk store.
+func chunkAsset(asset string) (err error) {
+	if err = validateAsset(asset); err != nil {
+		return
+	}
+	if isChunked(asset) || isEncrypted(asset) {
+		return
+	}
+	if err = chunkFile(asset, getAssetPath(asset)); err != nil {
+		return
+	}
+	// Make sure it comes back out the same before letting go of the original.
+	if err = checkAssetHash(asset); err != nil {
+		removeChunked(asset)
+		return
+	}
+	return os.Remove(getAssetPath(asset))
+}
+
+// Moves an asset out of the chunk store, back to a file in assetsDir().
+func unchunkAsset(asset string) (err error) {
+	if err = validateAsset(asset); err != nil {
+		return
+	}
+	if !isChunked(asset) {
+		return
+	}
+	reader, err := openChunkedAsset(asset)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	// Not in assetsDir(), or it would look like an asset.
+	fd, err := ioutil.TempFile(baseDir(), ".unchunk-")
+	if err != nil {
+		return
+	}
+	temporaryPath := fd.Name()
+	_, err = io.Copy(fd, reader)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temporaryPath, getAssetPath(asset))
+	}
+	if err != nil {
+		os.Remove(temporaryPath)
+		return
+	}
+	return removeChunked(asset)
+}
+
+// Chunks (or unchunks) one asset, or every asset if asset is "".
+func chunkAssets(asset string, chunk bool) (err error) {
+	convert := unchunkAsset
+	if chunk {
+		convert = chunkAsset
+	}
+	if asset != "" {
+		return convert(asset)
+	}
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	for _, asset := range all_assets {
+		if err = convert(asset); err != nil {
+			return fmt.Errorf("%s: %s", asset, err.Error())
+		}
+	}
+	return
+}
+
+func httpRecipe(w http.ResponseWriter, r *http.Request, asset string) {
+	recipeByte, err := ioutil.ReadFile(getRecipePath(asset))
+	if os.IsNotExist(err) {
+		http.Error(w, "Asset is not chunked here.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", revalidateCacheControl)
+	if _, err = w.Write(recipeByte); err != nil {
+		log.Print(err)
+	}
+}
+
+func httpChunk(w http.ResponseWriter, r *http.Request, chunk string) {
+	if err := validateChunkHash(chunk); err != nil {
+		httpHandle400(w, err)
+		return
+	}
+	fd, err := os.Open(getChunkPath(chunk))
+	if os.IsNotExist(err) {
+		http.Error(w, "No such chunk.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	defer fd.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", "\""+chunk+"\"")
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	http.ServeContent(w, r, chunk, time.Time{}, fd)
+}
+
+// Fetches a chunk from a mirror unless we have it, checking its hash.
+func downloadChunk(root string, chunk recipeChunk) (fetched bool, err error) {
+	if _, err = os.Stat(getChunkPath(chunk.Hash)); err == nil {
+		return
+	}
+	body, err := httpGet(root + "chunk/" + chunk.Hash)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(body, chunk.Size+1))
+	if err != nil {
+		return
+	}
+	if int64(len(data)) != chunk.Size {
+		err = fmt.Errorf("Chunk %s is the wrong size.", chunk.Hash)
+		return
+	}
+	hash, _, err := storeChunk(data)
+	if err == nil && hash != chunk.Hash {
+		os.Remove(getChunkPath(hash))
+		err = fmt.Errorf("%s does not match chunk %s", hash, chunk.Hash)
+	}
+	fetched = err == nil
+	return
+}
+
+// Syncs a chunked asset from a mirror, only downloading the chunks we don't
+// have. found is false if the mirror doesn't keep it chunked.
+func downloadChunkedAsset(root string, asset string) (found bool, err error) {
+	body, err := httpGet(root + "recipe/" + asset)
+	if err != nil {
+		// Mirrors without a chunk store, or with the asset as a plain file.
+		return false, nil
+	}
+	recipeByte, err := ioutil.ReadAll(io.LimitReader(body, 64*1024*1024))
+	body.Close()
+	if err != nil {
+		return
+	}
+	found = true
+	chunks, err := parseRecipe(string(recipeByte))
+	if err != nil {
+		return
+	}
+	var fetched []string
+	for _, chunk := range chunks {
+		var fresh bool
+		if fresh, err = downloadChunk(root, chunk); err != nil {
+			return
+		}
+		if fresh {
+			fetched = append(fetched, chunk.Hash)
+		}
+	}
+	log.Printf("%s: downloaded %d of %d chunks.", asset, len(fetched), len(chunks))
+	// Each chunk matched its hash, but check they add up to the asset
+	// before it shows up in the store.
+	algorithm, _, err := assetAlgorithmAndDigest(asset)
+	if err != nil {
+		return
+	}
+	reader := newChunkedAsset(chunks)
+	hash, err := hashReader(reader, algorithm)
+	reader.Close()
+	if err != nil {
+		return
+	}
+	if hash != asset {
+		err = fmt.Errorf("%s does not match %s", hash, asset)
+		// They weren't here before, so no recipe of ours uses them.
+		for _, chunk := range fetched {
+			if removeErr := os.Remove(getChunkPath(chunk)); removeErr != nil && !os.IsNotExist(removeErr) {
+				log.Print(removeErr)
+			}
+		}
+		return
+	}
+	err = writeRecipe(asset, chunks)
+	return
+}
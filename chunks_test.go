@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestSplitChunks(t *testing.T) {
+	data := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	split := func(data []byte) (chunks [][]byte) {
+		err := splitChunks(bytes.NewReader(data), func(chunk []byte) error {
+			chunks = append(chunks, append([]byte(nil), chunk...))
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Unable to split: %s", err.Error())
+		}
+		return
+	}
+	chunks := split(data)
+	if len(chunks) < 2 {
+		t.Errorf("8MiB should be more than one chunk, got %d", len(chunks))
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Errorf("Chunks should add up to the data")
+	}
+	for index, chunk := range chunks {
+		if len(chunk) > chunkMaxSize || (len(chunk) < chunkMinSize && index != len(chunks)-1) {
+			t.Errorf("Chunk %d is %d bytes", index, len(chunk))
+		}
+	}
+	// Inserting at the start should only change the first chunk.
+	shifted := split(append([]byte("inserted"), data...))
+	if len(shifted) != len(chunks) {
+		t.Errorf("Expected %d chunks after inserting, got %d", len(chunks), len(shifted))
+		return
+	}
+	for index := 1; index < len(chunks); index++ {
+		if !bytes.Equal(chunks[index], shifted[index]) {
+			t.Errorf("Chunk %d should not have changed", index)
+		}
+	}
+}
+
+func TestParseRecipe(t *testing.T) {
+	chunks := []recipeChunk{{Hash: "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26", Size: 12},
+		{Hash: "e59ff97941044f85df5297e1c302d260e59ff97941044f85df5297e1c302d260", Size: 5, Offset: 12}}
+	parsed, err := parseRecipe(formatRecipe(chunks))
+	if err != nil {
+		t.Errorf("Unable to parse recipe: %s", err.Error())
+	}
+	if len(parsed) != len(chunks) || parsed[0] != chunks[0] || parsed[1] != chunks[1] {
+		t.Errorf("Recipe didn't round trip: %v", parsed)
+	}
+	for _, recipe := range []string{"nothex 12\n", "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26\n", "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26 -1\n", "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26 4194305\n"} {
+		if _, err = parseRecipe(recipe); err == nil {
+			t.Errorf("%q should not parse", recipe)
+		}
+	}
+}
+
+func TestDownloadChunkedAssetMismatch(t *testing.T) {
+	t.Setenv("DECENSOR_DIR", t.TempDir()+"/store")
+	if err := init_folders(); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("not what the asset is")
+	sum := sha256.Sum256(data)
+	chunk := hex.EncodeToString(sum[:])
+	// A mirror whose recipe doesn't add up to the asset it claims to be.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunk/"+chunk {
+			w.Write(data)
+		} else {
+			io.WriteString(w, formatRecipe([]recipeChunk{{Hash: chunk, Size: int64(len(data))}}))
+		}
+	}))
+	defer server.Close()
+	asset := "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26"
+	found, err := downloadChunkedAsset(server.URL+"/", asset)
+	if !found || err == nil {
+		t.Fatalf("Expected a mismatch, got %v %v", found, err)
+	}
+	if _, err = os.Stat(getChunkPath(chunk)); !os.IsNotExist(err) {
+		t.Errorf("Chunks fetched for a mismatched asset should be removed")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Only keep a precompressed sidecar if it's at most this much of the original.
+const precompressMaxRatio = 0.9
+
+// Returns "gzip", "deflate" or "" depending on what the client accepts.
+func negotiateEncoding(r *http.Request) string {
+	var best string
+	var bestQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		if q <= 0 || (coding != "gzip" && coding != "deflate") {
+			continue
+		}
+		// Prefer gzip when both are equally acceptable, it's better supported.
+		if q > bestQ || (q == bestQ && coding == "gzip") {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding   string
+	status     int
+	started    bool
+	compressor io.WriteCloser
+}
+
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	// Held until the first Write() so we can still sniff the Content-Type.
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressResponseWriter) start(data []byte) {
+	cw.started = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	// Otherwise net/http would sniff our compressed bytes instead.
+	if cw.Header().Get("Content-Type") == "" && data != nil {
+		cw.Header().Set("Content-Type", http.DetectContentType(data))
+	}
+	// Nothing to compress for these, and the header would be a lie.
+	if cw.status != http.StatusNotModified && cw.status != http.StatusNoContent {
+		cw.Header().Set("Content-Encoding", cw.encoding)
+		cw.Header().Del("Content-Length")
+		if cw.encoding == "gzip" {
+			cw.compressor = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			// HTTP's deflate is the zlib format, not raw DEFLATE.
+			cw.compressor = zlib.NewWriter(cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressResponseWriter) Write(data []byte) (int, error) {
+	if !cw.started {
+		cw.start(data)
+	}
+	if cw.compressor == nil {
+		return cw.ResponseWriter.Write(data)
+	}
+	return cw.compressor.Write(data)
+}
+
+func (cw *compressResponseWriter) Close() error {
+	if !cw.started {
+		cw.start(nil)
+	}
+	if cw.compressor == nil {
+		return nil
+	}
+	return cw.compressor.Close()
+}
+
+// Wraps handlers that generate HTML or other text so they're compressed
+// when the client supports it. Not for assets, those need Range support.
+func compressHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r)
+		if encoding == "" || r.Method == http.MethodHead {
+			handler(w, r)
+			return
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer func() {
+			if err := cw.Close(); err != nil {
+				log.Print(err)
+			}
+		}()
+		handler(cw, r)
+	}
+}
+
+func getAssetFilePathGzip(asset string) string {
+	return metadataDir() + "/" + asset + "/gzip"
+}
+
+// Stores a gzipped copy of a textual asset next to its metadata so the web
+// server doesn't have to compress it on every request.
+func precompress(asset string) (saved bool, err error) {
+	if err = validateAsset(asset); err != nil {
+		return
+	}
+	// Compressed at rest is already as good as a sidecar, and a sidecar
+	// would be a plaintext copy of an encrypted asset.
+	if !isTextualMimeType(getAssetMimeType(asset)) || isCompressed(asset) || isEncrypted(asset) {
+		return
+	}
+	size, err := getAssetSize(asset)
+	if err != nil {
+		return
+	}
+	source, err := openAsset(asset)
+	if err != nil {
+		return
+	}
+	defer source.Close()
+	if err = init_metadata(asset); err != nil {
+		return
+	}
+	// Write to a temporary file so a half written sidecar is never served.
+	temporaryPath := getAssetFilePathGzip(asset) + ".tmp"
+	destination, err := os.Create(temporaryPath)
+	if err != nil {
+		return
+	}
+	compressor, _ := gzip.NewWriterLevel(destination, gzip.BestCompression)
+	_, err = io.Copy(compressor, source)
+	if err == nil {
+		err = compressor.Close()
+	}
+	if err == nil {
+		err = destination.Close()
+	} else {
+		destination.Close()
+	}
+	if err != nil {
+		os.Remove(temporaryPath)
+		return
+	}
+	stat, err := os.Stat(temporaryPath)
+	if err != nil {
+		return
+	}
+	if float64(stat.Size()) > float64(size)*precompressMaxRatio {
+		// Not worth it.
+		err = os.Remove(temporaryPath)
+		return
+	}
+	if err = os.Rename(temporaryPath, getAssetFilePathGzip(asset)); err != nil {
+		return
+	}
+	saved = true
+	return
+}
+
+func precompressAll() error {
+	all_assets, err := assets()
+	if err != nil {
+		return err
+	}
+	for _, asset := range all_assets {
+		saved, err := precompress(asset)
+		if err != nil {
+			log.Printf("Failure in precompressAll with asset: %s", asset)
+			return err
+		}
+		if saved {
+			log.Printf("Precompressed %s", asset)
+		}
+	}
+	return nil
+}
+
+// Opens the gzip sidecar, or the asset if it's compressed at rest, if we
+// have one and it makes sense to use it.
+func openPrecompressed(r *http.Request, asset string) (fd *os.File, err error) {
+	// Range requests are against the uncompressed bytes.
+	if r.Header.Get("Range") != "" || negotiateEncoding(r) != "gzip" {
+		err = errors.New("Not using precompressed asset.")
+		return
+	}
+	if isCompressed(asset) {
+		return os.Open(getCompressedPath(asset))
+	}
+	return os.Open(getAssetFilePathGzip(asset))
+}
+
+func hasPrecompressed(asset string) bool {
+	_, err := os.Stat(getAssetFilePathGzip(asset))
+	return err == nil || isCompressed(asset)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                       "",
+		"gzip":                   "gzip",
+		"deflate":                "deflate",
+		"deflate, gzip":          "gzip",
+		"gzip;q=0, deflate":      "deflate",
+		"gzip;q=0.5, deflate":    "deflate",
+		"br":                     "",
+		"identity, x-gzip;q=0.1": "gzip",
+	}
+	for acceptEncoding, expected := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		if encoding := negotiateEncoding(r); encoding != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, acceptEncoding, encoding)
+		}
+	}
+}
+
+func TestCompressHandlerDeflateIsZlib(t *testing.T) {
+	handler := compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<p>Hello</p>")
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "deflate")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Header().Get("Content-Encoding") != "deflate" {
+		t.Fatalf("Expected deflate, got %q", w.Header().Get("Content-Encoding"))
+	}
+	reader, err := zlib.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil || string(body) != "<p>Hello</p>" {
+		t.Errorf("Expected <p>Hello</p>, got %q %v", body, err)
+	}
+}
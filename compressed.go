@@ -0,0 +1,281 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// Compression at rest keeps textual assets gzipped under compressedDir()
+// instead of as a file in assetsDir(). Assets are still named by the hash of
+// the uncompressed bytes, openAsset() decompresses them, and web mode sends
+// the gzip as is to clients that accept it.
+//
+// Only assets with a textual mime type that compress to at most
+// precompressMaxRatio of their size are compressed.
+
+func compressedDir() string {
+	return baseDir() + "/compressed"
+}
+
+func getCompressedPath(asset string) string {
+	return compressedDir() + "/" + asset
+}
+
+// Compressed sizes say something about the plaintext, so encrypted stores skip it.
+func compressAtRestEnabled() bool {
+	return getSettingOrDefault("compress_at_rest") == "on" && !storeEncrypted()
+}
+
+func isCompressed(asset string) bool {
+	_, err := os.Stat(getCompressedPath(asset))
+	return err == nil
+}
+
+// Reads the uncompressed bytes of an asset. Seeking backwards starts
+// decompressing again from the start, which is fine for the sizes of text
+// we compress. Not safe for concurrent use.
+type compressedAsset struct {
+	fd           *os.File
+	decompressor *gzip.Reader
+	// How far into the uncompressed bytes decompressor is.
+	position int64
+	offset   int64
+	size     int64
+}
+
+func openCompressedAsset(asset string) (reader *compressedAsset, err error) {
+	fd, err := os.Open(getCompressedPath(asset))
+	if err != nil {
+		return
+	}
+	reader = &compressedAsset{fd: fd}
+	if err = reader.rewind(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	// The gzip trailer only has the size modulo 4GiB, so we keep it in the comment.
+	if reader.size, err = strconv.ParseInt(reader.decompressor.Comment, 10, 64); err != nil {
+		fd.Close()
+		return nil, errors.New("Compressed asset is missing its size.")
+	}
+	return
+}
+
+func (reader *compressedAsset) rewind() (err error) {
+	if _, err = reader.fd.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if reader.decompressor == nil {
+		reader.decompressor, err = gzip.NewReader(reader.fd)
+	} else {
+		err = reader.decompressor.Reset(reader.fd)
+	}
+	reader.position = 0
+	return
+}
+
+func (reader *compressedAsset) ReadAt(p []byte, offset int64) (n int, err error) {
+	if offset >= reader.size {
+		return 0, io.EOF
+	}
+	if offset < reader.position {
+		if err = reader.rewind(); err != nil {
+			return
+		}
+	}
+	if offset > reader.position {
+		skipped, err := io.CopyN(ioutil.Discard, reader.decompressor, offset-reader.position)
+		reader.position += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err = io.ReadFull(reader.decompressor, p)
+	reader.position += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err == io.EOF && reader.position != reader.size {
+		err = fmt.Errorf("Compressed asset is %d bytes, not %d.", reader.position, reader.size)
+	}
+	return
+}
+
+func (reader *compressedAsset) Read(p []byte) (n int, err error) {
+	if remaining := reader.size - reader.offset; remaining >= 0 && int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	if len(p) == 0 {
+		return 0, io.EOF
+	}
+	n, err = reader.ReadAt(p, reader.offset)
+	reader.offset += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return
+}
+
+func (reader *compressedAsset) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.size
+	default:
+		return 0, errors.New("Invalid whence.")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position.")
+	}
+	reader.offset = offset
+	return offset, nil
+}
+
+func (reader *compressedAsset) Close() error {
+	return reader.fd.Close()
+}
+
+// Compresses an asset at rest if it's worth it. compressed is false if it wasn't.
+func compressAsset(asset string) (compressed bool, err error) {
+	if err = validateAsset(asset); err != nil {
+		return
+	}
+	// Chunked assets are already deduplicated, keep it to one trick per asset.
+	if isCompressed(asset) || isChunked(asset) || isEncrypted(asset) {
+		return
+	}
+	if !isTextualMimeType(getAssetMimeType(asset)) {
+		return
+	}
+	size, err := getAssetSize(asset)
+	if err != nil {
+		return
+	}
+	source, err := os.Open(getAssetPath(asset))
+	if err != nil {
+		return
+	}
+	defer source.Close()
+	// Stores from before compression at rest won't have the directory.
+	if err = os.MkdirAll(compressedDir(), 0755); err != nil {
+		return
+	}
+	temporaryPath := getCompressedPath(asset) + ".tmp"
+	destination, err := os.Create(temporaryPath)
+	if err != nil {
+		return
+	}
+	compressor, _ := gzip.NewWriterLevel(destination, gzip.BestCompression)
+	compressor.Comment = strconv.FormatInt(size, 10)
+	_, err = io.Copy(compressor, source)
+	if err == nil {
+		err = compressor.Close()
+	}
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporaryPath)
+		return
+	}
+	stat, err := os.Stat(temporaryPath)
+	if err != nil {
+		return
+	}
+	if float64(stat.Size()) > float64(size)*precompressMaxRatio {
+		// Not worth it.
+		err = os.Remove(temporaryPath)
+		return
+	}
+	if err = os.Rename(temporaryPath, getCompressedPath(asset)); err != nil {
+		return
+	}
+	// Make sure it comes back out the same before letting go of the original.
+	if err = checkAssetHash(asset); err != nil {
+		os.Remove(getCompressedPath(asset))
+		return
+	}
+	if err = os.Remove(getAssetPath(asset)); err != nil {
+		return
+	}
+	// The compressed asset does the sidecar's job now.
+	if err = os.Remove(getAssetFilePathGzip(asset)); os.IsNotExist(err) {
+		err = nil
+	}
+	compressed = true
+	return
+}
+
+// Moves a compressed asset back to a plain file in assetsDir().
+func uncompressAsset(asset string) (err error) {
+	if err = validateAsset(asset); err != nil {
+		return
+	}
+	if !isCompressed(asset) {
+		return
+	}
+	reader, err := openCompressedAsset(asset)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	// Not in assetsDir(), or it would look like an asset.
+	fd, err := ioutil.TempFile(baseDir(), ".uncompress-")
+	if err != nil {
+		return
+	}
+	temporaryPath := fd.Name()
+	_, err = io.Copy(fd, reader)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temporaryPath, getAssetPath(asset))
+	}
+	if err != nil {
+		os.Remove(temporaryPath)
+		return
+	}
+	return os.Remove(getCompressedPath(asset))
+}
+
+// Compresses (or uncompresses) one asset, or every asset if asset is "".
+func compressAssets(asset string, compress bool) (err error) {
+	convert := uncompressAsset
+	if compress {
+		convert = func(asset string) error {
+			_, err := compressAsset(asset)
+			return err
+		}
+	}
+	if asset != "" {
+		return convert(asset)
+	}
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	for _, asset := range all_assets {
+		if err = convert(asset); err != nil {
+			return fmt.Errorf("%s: %s", asset, err.Error())
+		}
+	}
+	return
+}
+
+func getCompressedSize(asset string) (size int64, err error) {
+	reader, err := openCompressedAsset(asset)
+	if err != nil {
+		return
+	}
+	size = reader.size
+	err = reader.Close()
+	return
+}
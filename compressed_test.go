@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestCompressedAsset(t *testing.T) {
+	content := []byte{}
+	for i := 0; i < 10000; i++ {
+		content = append(content, []byte(strconv.Itoa(i)+"\n")...)
+	}
+	var compressed bytes.Buffer
+	compressor := gzip.NewWriter(&compressed)
+	compressor.Comment = strconv.Itoa(len(content))
+	compressor.Write(content)
+	compressor.Close()
+	path := t.TempDir() + "/compressed"
+	if err := ioutil.WriteFile(path, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := &compressedAsset{fd: fd, size: int64(len(content))}
+	defer reader.Close()
+	if err = reader.rewind(); err != nil {
+		t.Fatal(err)
+	}
+	all, err := ioutil.ReadAll(reader)
+	if err != nil || !bytes.Equal(all, content) {
+		t.Errorf("Should read back the uncompressed content: %v", err)
+	}
+	// Backwards, then forwards, like a Range request after a full read.
+	for _, offset := range []int64{100, 5000, 10} {
+		if _, err = reader.Seek(offset, io.SeekStart); err != nil {
+			t.Errorf("Unable to seek: %s", err.Error())
+		}
+		part := make([]byte, 20)
+		if _, err = io.ReadFull(reader, part); err != nil || !bytes.Equal(part, content[offset:offset+20]) {
+			t.Errorf("Wrong bytes at %d: %q %v", offset, part, err)
+		}
+	}
+	if size, _ := reader.Seek(0, io.SeekEnd); size != int64(len(content)) {
+		t.Errorf("Size should be %d, not %d", len(content), size)
+	}
+	if n, err := reader.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Should be at the end: %d %v", n, err)
+	}
+}
@@ -2,8 +2,6 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -11,7 +9,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 const decensorPathSuffix = "/.decensor"
@@ -28,42 +28,32 @@ func isHex(hexString string) bool {
 }
 
 func validate_asset(asset string) bool {
-	if len(asset) != 64 {
-		return false
-	}
 	if isHex(asset) == false {
 		return false
 	}
-	return true
+	// Legacy SHA256 assets are 64 hex characters, everything else is a hex multihash.
+	if isLegacyAsset(asset) {
+		return true
+	}
+	_, _, err := assetAlgorithmAndDigest(asset)
+	return err == nil
 }
 
 func validateAsset(asset string) error {
 	if validate_asset(asset) == false {
-		return errors.New("Assets must be 64 hex characters.")
+		return errors.New("Assets must be 64 hex characters or a hex multihash.")
 	} else {
 		return nil
 	}
 }
 
+// Hashes with the store's hash_algorithm, returning the asset name.
 func get_hash(path string) (string, error) {
-	// If we do this all in one chunk, we can easily run out of memory on big files.
-	// Instead, we use io.Copy and hash as we go.
-	var hash_string string
-
-	fd, err := os.Open(path)
+	algorithm, err := storeHashAlgorithm()
 	if err != nil {
-		return hash_string, err
+		return "", err
 	}
-	defer fd.Close()
-
-	hash := sha256.New()
-	_, err = io.Copy(hash, fd)
-	if err != nil {
-		return hash_string, err
-	}
-	hash_sum := hash.Sum(nil)
-	hash_string = hex.EncodeToString(hash_sum[:])
-	return hash_string, err
+	return hashFile(path, algorithm)
 }
 
 func copyFile(source, destination string) error {
@@ -85,6 +75,19 @@ func copyFile(source, destination string) error {
 }
 
 func getAssetSize(asset string) (bytes int64, err error) {
+	if isEncrypted(asset) {
+		return getEncryptedSize(asset)
+	}
+	if isCompressed(asset) {
+		return getCompressedSize(asset)
+	}
+	if isChunked(asset) {
+		chunks, err := readRecipe(asset)
+		for _, chunk := range chunks {
+			bytes += chunk.Size
+		}
+		return bytes, err
+	}
 	assetPath := getAssetPath(asset)
 	stat, err := os.Stat(assetPath)
 	if err != nil {
@@ -98,6 +101,107 @@ func getAssetPath(hash string) string {
 	return assetsDir() + "/" + hash
 }
 
+// An asset's contents, whether it's a file, in the chunk store, compressed or encrypted.
+type assetReader interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+}
+
+func openAsset(asset string) (assetReader, error) {
+	if isEncrypted(asset) {
+		return openEncryptedAsset(asset)
+	}
+	if isChunked(asset) {
+		return openChunkedAsset(asset)
+	}
+	if isCompressed(asset) {
+		return openCompressedAsset(asset)
+	}
+	return os.Open(getAssetPath(asset))
+}
+
+func assetExists(asset string) bool {
+	if _, err := os.Stat(getAssetPath(asset)); err == nil {
+		return true
+	}
+	return isChunked(asset) || isCompressed(asset) || isEncrypted(asset)
+}
+
+// When the asset (or its recipe) was written.
+func getAssetModTime(asset string) (modTime time.Time, err error) {
+	path := getAssetPath(asset)
+	if isEncrypted(asset) {
+		path = getEncryptedPath(asset)
+	} else if isChunked(asset) {
+		path = getRecipePath(asset)
+	} else if isCompressed(asset) {
+		path = getCompressedPath(asset)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	modTime = stat.ModTime()
+	return
+}
+
+// Hashes an asset with the algorithm its name says it uses and checks it matches.
+func checkAssetHash(asset string) error {
+	return checkAssetHashLimited(asset, nil)
+}
+
+// Same, reading no faster than limiter allows if it isn't nil.
+func checkAssetHashLimited(asset string, limiter *rateLimiter) (err error) {
+	algorithm, _, err := assetAlgorithmAndDigest(asset)
+	if err != nil {
+		return
+	}
+	reader, err := openAsset(asset)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	hash, err := hashReader(limitedReader{reader, limiter}, algorithm)
+	if err != nil {
+		return
+	}
+	if hash != asset {
+		err = fmt.Errorf("%s does not match %s", hash, asset)
+	}
+	return
+}
+
+// Moves a file we know matches asset into the store, or into the chunk
+// store if chunk_store is on, or encrypts it if the store is encrypted.
+func storeAssetFile(asset string, path string) (err error) {
+	if storeEncrypted() {
+		if err = encryptFile(asset, path); err != nil {
+			return
+		}
+		return os.Remove(path)
+	}
+	if !chunkStoreEnabled() {
+		if err = os.Rename(path, getAssetPath(asset)); err != nil {
+			return
+		}
+		return compressNewAsset(asset)
+	}
+	if err = chunkFile(asset, path); err != nil {
+		return
+	}
+	return os.Remove(path)
+}
+
+// Compresses a newly stored asset if compress_at_rest is on and it's worth it.
+func compressNewAsset(asset string) (err error) {
+	if !compressAtRestEnabled() {
+		return
+	}
+	_, err = compressAsset(asset)
+	return
+}
+
 func add(path string) (hash string, err error) {
 	/* This also checks if we can read the source file. */
 	hash, err = get_hash(path)
@@ -105,19 +209,42 @@ func add(path string) (hash string, err error) {
 		return hash, err
 	}
 	/* Make sure we don't already have the asset. */
-	asset_path := getAssetPath(hash)
-	if _, err = os.Stat(asset_path); err == nil {
+	if assetExists(hash) {
 		return hash, errors.New("Asset already exists.")
 	}
-	err = copyFile(path, asset_path)
+	if storeEncrypted() {
+		err = encryptFile(hash, path)
+	} else if chunkStoreEnabled() {
+		err = chunkFile(hash, path)
+	} else if err = copyFile(path, getAssetPath(hash)); err == nil {
+		err = compressNewAsset(hash)
+	}
 	if err != nil {
 		return hash, err
 	}
 	// In case someone is adding /dir/foo.jpg and not foo.jpg
-	filename := filepath.Base(path)
-	if err = addFilename(hash, filename); err != nil {
+	err = addAssetMetadata(hash, filepath.Base(path))
+	return
+}
+
+// Everything we record about a newly stored asset.
+func addAssetMetadata(asset string, filename string) (err error) {
+	if err = addFilename(asset, filename); err != nil {
+		return
+	}
+	if err = addAddedAt(asset, time.Now()); err != nil {
+		return
+	}
+	if _, err = addCID(asset); err != nil {
+		return
+	}
+	if err = addChecksums(asset); err != nil {
 		return
 	}
+	if err = addTorrentHashes(asset); err != nil {
+		return
+	}
+	err = journalAsset("add", asset)
 	return
 }
 
@@ -126,9 +253,7 @@ func remove(asset string) error {
 	if err = validateAsset(asset); err != nil {
 		return err
 	}
-	asset_path := assetsDir() + "/" + asset
-	_, err = os.Stat(asset_path)
-	if os.IsNotExist(err) {
+	if !assetExists(asset) {
 		return errors.New("Asset does not exist, cannot remove.")
 	}
 	filename := getAssetFilename(asset)
@@ -138,7 +263,11 @@ func remove(asset string) error {
 		return err
 	}
 	for _, tag := range tags_for_asset {
-		if err = os.Remove(tagsDir() + "/" + tag + "/" + asset); err != nil {
+		tagPath, err := getTagPath(tag)
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(tagPath + "/" + asset); err != nil {
 			return err
 		} else {
 			log.Printf("Removed from tag %s", tag)
@@ -161,9 +290,19 @@ func remove(asset string) error {
 	} else {
 		log.Print("No metadata for asset found.")
 	}
-	err = os.Remove(asset_path)
-	// We'll return nil if os.Remove was fine.
-	return err
+	if isEncrypted(asset) {
+		err = os.Remove(getEncryptedPath(asset))
+	} else if isChunked(asset) {
+		err = removeChunked(asset)
+	} else if isCompressed(asset) {
+		err = os.Remove(getCompressedPath(asset))
+	} else {
+		err = os.Remove(getAssetPath(asset))
+	}
+	if err != nil {
+		return err
+	}
+	return journalAsset("remove", asset)
 }
 
 func init_metadata(asset string) error {
@@ -197,11 +336,41 @@ func addFilename(asset string, filename string) error {
 	if err = init_metadata(asset); err != nil {
 		return err
 	}
+	if storeEncrypted() {
+		if filename, err = encryptFilename(asset, filename); err != nil {
+			return err
+		}
+	}
 	path = getAssetFilePathFilename(asset)
 	err = ioutil.WriteFile(path, []byte(filename+"\n"), 0644)
 	return err
 }
 
+func addAddedAt(asset string, addedAt time.Time) error {
+	var err error
+	if err = init_metadata(asset); err != nil {
+		return err
+	}
+	path := getAssetFilePathAddedAt(asset)
+	err = ioutil.WriteFile(path, []byte(addedAt.UTC().Format(time.RFC3339)+"\n"), 0644)
+	return err
+}
+
+func getAssetAddedAt(asset string) (addedAt time.Time, err error) {
+	addedAtByte, err := ioutil.ReadFile(getAssetFilePathAddedAt(asset))
+	if err == nil {
+		addedAt, err = time.Parse(time.RFC3339, strings.Trim(string(addedAtByte), "\n"))
+		return
+	}
+	// Assets added before we recorded this. The asset is a copy made
+	// when it was added, so its mtime is close enough.
+	return getAssetModTime(asset)
+}
+
+func getAssetFilePathAddedAt(asset string) string {
+	return metadataDir() + "/" + asset + "/added"
+}
+
 func getAssetFilePathFilename(asset string) string {
 	return metadataDir() + "/" + asset + "/filename"
 }
@@ -216,6 +385,9 @@ func getAssetFilename(asset string) (filename string) {
 		filename = asset
 	} else {
 		filename = strings.Trim(string(filenameByte), "\n")
+		if filename, err = decryptFilename(asset, filename); err != nil {
+			filename = asset
+		}
 	}
 	return
 }
@@ -242,6 +414,10 @@ func metadataDir() string {
 	return baseDir() + "/metadata"
 }
 
+func settingsDir() string {
+	return baseDir() + "/settings"
+}
+
 func assetsDir() string {
 	return baseDir() + "/assets"
 }
@@ -289,16 +465,49 @@ func list_directory_unsorted(directory string) ([]string, error) {
 	return entries, nil
 }
 
+// Files in assetsDir(), recipes in the chunk store, compressed and encrypted assets.
 func assets() ([]string, error) {
-	return list_directory(assetsDir())
+	all_assets, err := list_directory(assetsDir())
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, asset := range all_assets {
+		seen[asset] = true
+	}
+	for _, directory := range []string{recipesDir(), compressedDir(), encryptedDir()} {
+		stored, err := list_directory(directory)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, asset := range stored {
+			// Skip files being written, and assets part way through moving.
+			if validate_asset(asset) && !seen[asset] {
+				seen[asset] = true
+				all_assets = append(all_assets, asset)
+			}
+		}
+	}
+	sort.Strings(all_assets)
+	return all_assets, nil
 }
 
 func tags() ([]string, error) {
-	return list_directory(tagsDir())
+	names, err := list_directory(tagsDir())
+	if err != nil {
+		return nil, err
+	}
+	return decodeTags(names)
 }
 
 func assets_by_tag(tag string) ([]string, error) {
-	return list_directory(tagsDir() + "/" + tag)
+	directory, err := getTagPath(tag)
+	if err != nil {
+		return nil, err
+	}
+	return list_directory(directory)
 }
 
 func tags_by_asset(asset string) (tags []string) {
@@ -333,7 +542,11 @@ func forward_tags_by_asset(asset string) ([]string, error) {
 }
 
 func back_tags_by_asset(asset string) ([]string, error) {
-	return list_directory(getAssetFilePathTags(asset))
+	names, err := list_directory(getAssetFilePathTags(asset))
+	if err != nil {
+		return nil, err
+	}
+	return decodeTags(names)
 }
 
 func validate_asset_tags_forward_and_back(asset string) error {
@@ -342,7 +555,8 @@ func validate_asset_tags_forward_and_back(asset string) error {
 		return err
 	}
 	back_tags, err := back_tags_by_asset(asset)
-	if err != nil {
+	// Assets that were never tagged have no back tags directory.
+	if err != nil && !os.IsNotExist(err) {
 		log.Print(err.Error())
 	}
 	if len(forward_tags) != len(back_tags) {
@@ -364,7 +578,11 @@ func back_tag(asset string, tag string) error {
 	if err = init_back_tags(asset); err != nil {
 		return err
 	}
-	path := getAssetFilePathTags(asset) + tag
+	name, err := encodeTag(tag)
+	if err != nil {
+		return err
+	}
+	path := getAssetFilePathTags(asset) + name
 	err = ioutil.WriteFile(path, []byte(""), 0644)
 	return err
 }
@@ -375,7 +593,10 @@ func tag(asset string, tags []string) error {
 		return err
 	}
 	for _, tag := range tags {
-		directory := tagsDir() + "/" + tag
+		var directory string
+		if directory, err = getTagPath(tag); err != nil {
+			return err
+		}
 		_, err = os.Stat(directory)
 		/* Make the tag if it doesn't exist already */
 		if os.IsNotExist(err) {
@@ -404,12 +625,14 @@ func tag(asset string, tags []string) error {
 		if err = back_tag(asset, tag); err != nil {
 			return err
 		}
+		if err = journalTag(asset, tag); err != nil {
+			return err
+		}
 	}
 	return err
 }
 
 func validate_assets() error {
-	var hash string
 	var err error
 
 	assets, err := assets()
@@ -417,13 +640,10 @@ func validate_assets() error {
 		return err
 	}
 	for _, asset := range assets {
-		hash, err = get_hash(assetsDir() + "/" + asset)
-		if err != nil {
+		// Each asset is checked with the algorithm its name says it uses.
+		if err = checkAssetHash(asset); err != nil {
 			return err
 		}
-		if asset != hash {
-			return errors.New(fmt.Sprintf("%s does not match %s", hash, asset))
-		}
 		if err = validate_asset_tags_forward_and_back(asset); err != nil {
 			return err
 		}
@@ -440,28 +660,47 @@ func back_tag_all_assets() error {
 		return err
 	}
 	for _, asset := range all_assets {
-		asset_tags, err := forward_tags_by_asset(asset)
-		if err != nil {
+		if err = back_tag_asset(asset); err != nil {
 			log.Printf("Failure in back_tag_all_assets with asset: %s", asset)
 			return err
 		}
-		for _, tag := range asset_tags {
-			err := back_tag(asset, tag)
-			if err != nil {
-				log.Printf("Failure in back_tag_all_assets with asset: %s", asset)
-				return err
-			}
-		}
 	}
 	return err
 }
 
+// Adds a back tag for every tag the asset is in.
+func back_tag_asset(asset string) error {
+	asset_tags, err := forward_tags_by_asset(asset)
+	if err != nil {
+		return err
+	}
+	for _, tag := range asset_tags {
+		if err = back_tag(asset, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func info(asset string) (info_string string) {
 	var filename string
 	filename = getAssetFilename(asset)
 	var asset_tags []string
 	asset_tags = tags_by_asset(asset)
-	info_string = asset + "\nFilename: " + filename + "Tags:\n"
+	info_string = asset + "\nFilename: " + filename + "\n"
+	info_string += "Multihash: " + assetMultihashString(asset) + "\n"
+	for _, algorithm := range secondaryHashes {
+		if checksum, err := getAssetChecksum(asset, algorithm.name); err == nil {
+			info_string += strings.ToUpper(algorithm.name) + ": " + checksum + "\n"
+		}
+	}
+	if cid, err := getAssetCID(asset); err == nil {
+		info_string += "IPFS CID: " + cid + "\n"
+	}
+	for _, publisher := range publishers_by_asset(asset) {
+		info_string += "Attested by: " + publisher + "\n"
+	}
+	info_string += "Tags:"
 	for _, tag := range asset_tags {
 		info_string = info_string + "\n" + tag
 	}
@@ -482,5 +721,8 @@ func init_folders() error {
 	if err = os.Mkdir(metadataDir(), 0755); err != nil {
 		return err
 	}
+	if err = os.Mkdir(settingsDir(), 0755); err != nil {
+		return err
+	}
 	return nil
 }
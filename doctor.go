@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Interrupted commands and edits by hand can leave the store inconsistent
+// in ways the rest of decensor tolerates but never cleans up. doctor finds
+// them and, if asked, fixes them.
+
+// Temporary files and chunks younger than this may belong to a command
+// that's still running, so they're left alone.
+const doctorMinimumAge = time.Hour
+
+type doctorProblem struct {
+	Category string
+	Subject  string
+}
+
+func (problem doctorProblem) String() string {
+	return problem.Category + ": " + problem.Subject
+}
+
+// Each check reports what it finds, fixing it as it goes if fix is set.
+type doctorCheck func(fix bool) ([]doctorProblem, error)
+
+// In the order they run. Dangling tag links go before empty tags, since
+// dropping them can empty a tag.
+var doctorChecks = []doctorCheck{
+	doctorTagLinks,
+	doctorBackTags,
+	doctorOrphanedMetadata,
+	doctorLeftoverCopies,
+	doctorUnusedChunks,
+	doctorTemporaryFiles,
+}
+
+func doctor(fix bool) (problems []doctorProblem, err error) {
+	for _, check := range doctorChecks {
+		found, err := check(fix)
+		problems = append(problems, found...)
+		if err != nil {
+			return problems, err
+		}
+	}
+	return
+}
+
+func olderThan(info os.FileInfo, age time.Duration) bool {
+	return time.Since(info.ModTime()) > age
+}
+
+// Tag entries for assets we don't have, and tags with nothing left in them.
+func doctorTagLinks(fix bool) (problems []doctorProblem, err error) {
+	all_tags, err := tags()
+	if err != nil {
+		return
+	}
+	for _, tag := range all_tags {
+		directory, err := getTagPath(tag)
+		if err != nil {
+			return problems, err
+		}
+		tag_assets, err := list_directory(directory)
+		if err != nil {
+			return problems, err
+		}
+		remaining := 0
+		for _, asset := range tag_assets {
+			if validate_asset(asset) && assetExists(asset) {
+				remaining++
+				continue
+			}
+			problems = append(problems, doctorProblem{"Dangling tag link", tag + "/" + asset})
+			if fix {
+				if err = os.Remove(directory + "/" + asset); err != nil {
+					return problems, err
+				}
+			}
+		}
+		if remaining == 0 {
+			problems = append(problems, doctorProblem{"Empty tag", tag})
+			if fix {
+				if err = os.Remove(directory); err != nil {
+					return problems, err
+				}
+			}
+		}
+	}
+	return
+}
+
+// Back tags that don't match the tags an asset is in. The tag directories
+// are what counts, back tags are rebuilt from them.
+func doctorBackTags(fix bool) (problems []doctorProblem, err error) {
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	for _, asset := range all_assets {
+		if validate_asset_tags_forward_and_back(asset) == nil {
+			continue
+		}
+		problems = append(problems, doctorProblem{"Back tags do not match", asset})
+		if fix {
+			if err = rebuild_back_tags(asset); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func rebuild_back_tags(asset string) error {
+	forward_tags, err := forward_tags_by_asset(asset)
+	if err != nil {
+		return err
+	}
+	in_tag := make(map[string]bool)
+	for _, tag := range forward_tags {
+		in_tag[tag] = true
+	}
+	// No back tags at all is fine, back_tag_asset makes the directory.
+	back_tags, _ := back_tags_by_asset(asset)
+	for _, tag := range back_tags {
+		if in_tag[tag] {
+			continue
+		}
+		name, err := encodeTag(tag)
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(getAssetFilePathTags(asset) + name); err != nil {
+			return err
+		}
+	}
+	return back_tag_asset(asset)
+}
+
+// Metadata for assets we don't have, which remove leaves if the asset went first.
+func doctorOrphanedMetadata(fix bool) (problems []doctorProblem, err error) {
+	names, err := list_directory(metadataDir())
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if validate_asset(name) && assetExists(name) {
+			continue
+		}
+		problems = append(problems, doctorProblem{"Orphaned metadata", name})
+		if fix {
+			if err = os.RemoveAll(metadataDir() + "/" + name); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Copies of an asset besides the one openAsset() reads, from an interrupted
+// chunk, compress or encrypt. A gzip sidecar is a leftover copy once the
+// asset is compressed at rest or encrypted.
+func doctorLeftoverCopies(fix bool) (problems []doctorProblem, err error) {
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	for _, asset := range all_assets {
+		var leftovers []string
+		if isEncrypted(asset) && isChunked(asset) {
+			leftovers = append(leftovers, "chunked")
+		}
+		if (isEncrypted(asset) || isChunked(asset)) && isCompressed(asset) {
+			leftovers = append(leftovers, "compressed")
+		}
+		if _, statErr := os.Stat(getAssetPath(asset)); statErr == nil && (isEncrypted(asset) || isChunked(asset) || isCompressed(asset)) {
+			leftovers = append(leftovers, "file")
+		}
+		if _, statErr := os.Stat(getAssetFilePathGzip(asset)); statErr == nil && (isEncrypted(asset) || isCompressed(asset)) {
+			leftovers = append(leftovers, "gzip")
+		}
+		if len(leftovers) == 0 {
+			continue
+		}
+		problems = append(problems, doctorProblem{"Leftover copy", asset + " (" + strings.Join(leftovers, ", ") + ")"})
+		if !fix {
+			continue
+		}
+		// Only let go of the others if the one we use is good.
+		if err = checkAssetHash(asset); err != nil {
+			return problems, errors.New("Not removing leftover copies, " + err.Error())
+		}
+		for _, leftover := range leftovers {
+			switch leftover {
+			case "chunked":
+				err = removeChunked(asset)
+			case "compressed":
+				err = os.Remove(getCompressedPath(asset))
+			case "file":
+				err = os.Remove(getAssetPath(asset))
+			case "gzip":
+				err = os.Remove(getAssetFilePathGzip(asset))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Chunks no recipe uses, from an interrupted chunk or remove.
+func doctorUnusedChunks(fix bool) (problems []doctorProblem, err error) {
+	chunks, err := list_directory(chunksDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	inUse, err := chunksInUse("")
+	if err != nil {
+		return
+	}
+	for _, chunk := range chunks {
+		if inUse[chunk] || validateChunkHash(chunk) != nil {
+			continue
+		}
+		info, err := os.Stat(getChunkPath(chunk))
+		if err != nil {
+			return problems, err
+		}
+		// chunkFile writes chunks before the recipe that uses them.
+		if !olderThan(info, doctorMinimumAge) {
+			continue
+		}
+		problems = append(problems, doctorProblem{"Unused chunk", chunk})
+		if fix {
+			if err = os.Remove(getChunkPath(chunk)); err != nil {
+				return problems, err
+			}
+		}
+	}
+	return
+}
+
+func isTemporaryFile(name string) bool {
+	if strings.HasSuffix(name, ".tmp") {
+		return true
+	}
+	for _, prefix := range []string{".unchunk-", ".uncompress-", ".download-"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Temporary files from interrupted writes. Partial pushes and uploads are
+// meant to be resumed, so they're left to expire on their own.
+func doctorTemporaryFiles(fix bool) (problems []doctorProblem, err error) {
+	root := baseDir()
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// Tag names can look like anything, back tags included.
+			switch {
+			case path == filepath.Clean(incomingDir()), path == filepath.Clean(uploadsDir()), path == filepath.Clean(tagsDir()):
+				return filepath.SkipDir
+			case info.Name() == "tags" && filepath.Dir(filepath.Dir(path)) == filepath.Clean(metadataDir()):
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isTemporaryFile(info.Name()) || !olderThan(info, doctorMinimumAge) {
+			return nil
+		}
+		relative, _ := filepath.Rel(root, path)
+		problems = append(problems, doctorProblem{"Temporary file", relative})
+		if fix {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	return
+}
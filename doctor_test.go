@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsTemporaryFile(t *testing.T) {
+	for _, name := range []string{"gzip.tmp", "manifest.tmp", ".unchunk-123", ".uncompress-456", ".download-789"} {
+		if !isTemporaryFile(name) {
+			t.Errorf("%s should be a temporary file", name)
+		}
+	}
+	for _, name := range []string{"gzip", "tmp", "journal", "unchunk-123", "0263829989b6fd954f72baaf2fc64bc2e2f01d692d4de72986ea808f6e99813f"} {
+		if isTemporaryFile(name) {
+			t.Errorf("%s should not be a temporary file", name)
+		}
+	}
+}
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Encrypted stores keep asset bytes under encryptedDir(), and filenames and
+// tag names wherever they would normally be, encrypted with keys derived
+// from a passphrase. Assets are still named by the hash of their plaintext,
+// so once the store is unlocked everything works the same.
+//
+// Asset bytes are sealed with AES-256-GCM in segments so they can be read
+// from any offset. Each asset has its own key, derived from the asset name,
+// and segments use their index as the nonce. The last segment is marked so
+// truncation is caught. Since an asset's name is the hash of its bytes, a
+// key never seals two different plaintexts.
+//
+// Sizes, mime types and checksums are not encrypted.
+
+const (
+	passphraseEnvironment = "DECENSOR_PASSPHRASE"
+	encryptionIterations  = 600000
+	encryptedSegmentSize  = 64 * 1024
+	encryptedSegmentTag   = 16
+	// Marks filenames that are encrypted, in case encrypt was interrupted.
+	encryptedFilenamePrefix = "encrypted:"
+)
+
+var errStoreLocked = errors.New("Store is locked, run decensor unlock.")
+
+type storeKeys struct {
+	content   []byte
+	filenames []byte
+	tags      []byte
+	tagNonces []byte
+}
+
+var (
+	unlockedKeys      *storeKeys
+	unlockedKeysMutex sync.Mutex
+	// Web mode has nobody to ask, it waits for decensor unlock instead.
+	promptForPassphrase = true
+)
+
+func encryptionDir() string {
+	return baseDir() + "/encryption"
+}
+
+func encryptedDir() string {
+	return baseDir() + "/encrypted"
+}
+
+func getEncryptedPath(asset string) string {
+	return encryptedDir() + "/" + asset
+}
+
+func getUnlockSocketPath() string {
+	return baseDir() + "/unlock.sock"
+}
+
+// The check file is written last, so a store is only encrypted once it's all set up.
+func storeEncrypted() bool {
+	_, err := os.Stat(encryptionDir() + "/check")
+	return err == nil
+}
+
+func isEncrypted(asset string) bool {
+	_, err := os.Stat(getEncryptedPath(asset))
+	return err == nil
+}
+
+func storeLocked() bool {
+	if !storeEncrypted() {
+		return false
+	}
+	unlockedKeysMutex.Lock()
+	defer unlockedKeysMutex.Unlock()
+	return unlockedKeys == nil
+}
+
+// PBKDF2 (RFC 8018) with HMAC-SHA256.
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < length; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for iteration := 1; iteration < iterations; iteration++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for index := range t {
+				t[index] ^= u[index]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:length]
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func readEncryptionFile(name string) (value string, err error) {
+	valueByte, err := ioutil.ReadFile(encryptionDir() + "/" + name)
+	value = strings.Trim(string(valueByte), "\n")
+	return
+}
+
+func deriveStoreKeys(passphrase string) (keys *storeKeys, err error) {
+	saltHex, err := readEncryptionFile("salt")
+	if err != nil {
+		return
+	}
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return
+	}
+	iterationsString, err := readEncryptionFile("iterations")
+	if err != nil {
+		return
+	}
+	iterations, err := strconv.Atoi(iterationsString)
+	if err != nil || iterations < 1 {
+		return nil, errors.New("Invalid iterations in " + encryptionDir())
+	}
+	checkHex, err := readEncryptionFile("check")
+	if err != nil {
+		return
+	}
+	check, err := hex.DecodeString(checkHex)
+	if err != nil {
+		return
+	}
+	master := pbkdf2SHA256([]byte(passphrase), salt, iterations, 32)
+	if !hmac.Equal(deriveKey(master, "check"), check) {
+		return nil, errors.New("Wrong passphrase.")
+	}
+	keys = &storeKeys{
+		content:   deriveKey(master, "content"),
+		filenames: deriveKey(master, "filenames"),
+		tags:      deriveKey(master, "tags"),
+		tagNonces: deriveKey(master, "tag nonces")}
+	return
+}
+
+func unlockStore(passphrase string) (err error) {
+	keys, err := deriveStoreKeys(passphrase)
+	if err != nil {
+		return
+	}
+	unlockedKeysMutex.Lock()
+	unlockedKeys = keys
+	unlockedKeysMutex.Unlock()
+	return
+}
+
+func readPassphrase() (passphrase string, err error) {
+	if passphrase = os.Getenv(passphraseEnvironment); passphrase != "" {
+		return
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err == io.EOF {
+		err = nil
+	}
+	passphrase = strings.TrimRight(line, "\r\n")
+	if err == nil && passphrase == "" {
+		err = errors.New("A passphrase is required.")
+	}
+	return
+}
+
+// Asks for the passphrase the first time we need it, outside of web mode.
+func getStoreKeys() (keys *storeKeys, err error) {
+	unlockedKeysMutex.Lock()
+	keys = unlockedKeys
+	unlockedKeysMutex.Unlock()
+	if keys != nil {
+		return
+	}
+	if !promptForPassphrase {
+		return nil, errStoreLocked
+	}
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return
+	}
+	if err = unlockStore(passphrase); err != nil {
+		return
+	}
+	return getStoreKeys()
+}
+
+func setupEncryption(passphrase string) (err error) {
+	if err = os.MkdirAll(encryptionDir(), 0755); err != nil {
+		return
+	}
+	salt := make([]byte, 32)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(encryptionDir()+"/salt", []byte(hex.EncodeToString(salt)+"\n"), 0644); err != nil {
+		return
+	}
+	iterations := strconv.Itoa(encryptionIterations)
+	if err = ioutil.WriteFile(encryptionDir()+"/iterations", []byte(iterations+"\n"), 0644); err != nil {
+		return
+	}
+	master := pbkdf2SHA256([]byte(passphrase), salt, encryptionIterations, 32)
+	check := hex.EncodeToString(deriveKey(master, "check"))
+	if err = ioutil.WriteFile(encryptionDir()+"/check", []byte(check+"\n"), 0644); err != nil {
+		return
+	}
+	return unlockStore(passphrase)
+}
+
+func segmentNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func assetAEAD(asset string) (aead cipher.AEAD, err error) {
+	keys, err := getStoreKeys()
+	if err != nil {
+		return
+	}
+	return newAEAD(deriveKey(keys.content, asset))
+}
+
+// Seals everything source has into encryptedDir().
+func encryptAssetFrom(asset string, source io.Reader) (err error) {
+	aead, err := assetAEAD(asset)
+	if err != nil {
+		return
+	}
+	// Stores from before encryption won't have the directory.
+	if err = os.MkdirAll(encryptedDir(), 0755); err != nil {
+		return
+	}
+	temporaryPath := getEncryptedPath(asset) + ".tmp"
+	destination, err := os.Create(temporaryPath)
+	if err != nil {
+		return
+	}
+	err = sealSegments(aead, source, destination)
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temporaryPath, getEncryptedPath(asset))
+	}
+	if err != nil {
+		os.Remove(temporaryPath)
+	}
+	return
+}
+
+func sealSegments(aead cipher.AEAD, source io.Reader, destination io.Writer) (err error) {
+	reader := bufio.NewReaderSize(source, encryptedSegmentSize)
+	segment := make([]byte, encryptedSegmentSize)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(reader, segment)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// A full segment is only the last one if nothing comes after it.
+		last := err != nil
+		if !last {
+			if _, err = reader.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if _, err = destination.Write(aead.Seal(nil, segmentNonce(index, last), segment[:n], nil)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func encryptFile(asset string, path string) (err error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer source.Close()
+	return encryptAssetFrom(asset, source)
+}
+
+// Works out the plaintext size and number of segments from the sealed size.
+func encryptedSize(sealedSize int64) (size int64, segments int64, err error) {
+	sealedSegment := int64(encryptedSegmentSize + encryptedSegmentTag)
+	segments = (sealedSize + sealedSegment - 1) / sealedSegment
+	size = sealedSize - segments*encryptedSegmentTag
+	// Even an empty asset has one segment with its tag.
+	if segments == 0 || sealedSize-(segments-1)*sealedSegment < encryptedSegmentTag {
+		err = errors.New("Encrypted asset is truncated.")
+	}
+	return
+}
+
+func getEncryptedSize(asset string) (size int64, err error) {
+	stat, err := os.Stat(getEncryptedPath(asset))
+	if err != nil {
+		return
+	}
+	size, _, err = encryptedSize(stat.Size())
+	return
+}
+
+// Reads the plaintext of an encrypted asset. Not safe for concurrent use.
+type encryptedAsset struct {
+	fd       *os.File
+	aead     cipher.AEAD
+	size     int64
+	segments int64
+	offset   int64
+	// The last segment we opened, since reads tend to go along in order.
+	cachedIndex int64
+	cached      []byte
+}
+
+func openEncryptedAsset(asset string) (reader *encryptedAsset, err error) {
+	aead, err := assetAEAD(asset)
+	if err != nil {
+		return
+	}
+	fd, err := os.Open(getEncryptedPath(asset))
+	if err != nil {
+		return
+	}
+	reader = &encryptedAsset{fd: fd, aead: aead, cachedIndex: -1}
+	stat, err := fd.Stat()
+	if err == nil {
+		reader.size, reader.segments, err = encryptedSize(stat.Size())
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return
+}
+
+func (reader *encryptedAsset) segment(index int64) (plaintext []byte, err error) {
+	if index == reader.cachedIndex {
+		return reader.cached, nil
+	}
+	sealedSegment := int64(encryptedSegmentSize + encryptedSegmentTag)
+	sealed := make([]byte, sealedSegment)
+	n, err := reader.fd.ReadAt(sealed, index*sealedSegment)
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	last := index == reader.segments-1
+	if plaintext, err = reader.aead.Open(sealed[:0], segmentNonce(index, last), sealed[:n], nil); err != nil {
+		return nil, fmt.Errorf("Encrypted asset segment %d does not decrypt.", index)
+	}
+	reader.cachedIndex = index
+	reader.cached = plaintext
+	return
+}
+
+func (reader *encryptedAsset) ReadAt(p []byte, offset int64) (n int, err error) {
+	for n < len(p) {
+		if offset >= reader.size {
+			return n, io.EOF
+		}
+		index := offset / encryptedSegmentSize
+		plaintext, err := reader.segment(index)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], plaintext[offset-index*encryptedSegmentSize:])
+		n += copied
+		offset += int64(copied)
+	}
+	return
+}
+
+func (reader *encryptedAsset) Read(p []byte) (n int, err error) {
+	n, err = reader.ReadAt(p, reader.offset)
+	reader.offset += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return
+}
+
+func (reader *encryptedAsset) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.size
+	default:
+		return 0, errors.New("Invalid whence.")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position.")
+	}
+	reader.offset = offset
+	return offset, nil
+}
+
+func (reader *encryptedAsset) Close() error {
+	return reader.fd.Close()
+}
+
+// Filenames get a random nonce and are tied to their asset.
+func encryptFilename(asset string, filename string) (encrypted string, err error) {
+	keys, err := getStoreKeys()
+	if err != nil {
+		return
+	}
+	aead, err := newAEAD(keys.filenames)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(filename), []byte(asset))
+	encrypted = encryptedFilenamePrefix + base64.StdEncoding.EncodeToString(sealed)
+	return
+}
+
+// Returns stored as is if it isn't encrypted.
+func decryptFilename(asset string, stored string) (filename string, err error) {
+	if !strings.HasPrefix(stored, encryptedFilenamePrefix) || !storeEncrypted() {
+		return stored, nil
+	}
+	keys, err := getStoreKeys()
+	if err != nil {
+		return
+	}
+	aead, err := newAEAD(keys.filenames)
+	if err != nil {
+		return
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedFilenamePrefix))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("Invalid encrypted filename.")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(asset))
+	if err != nil {
+		return "", errors.New("Encrypted filename does not decrypt.")
+	}
+	filename = string(plaintext)
+	return
+}
+
+// Tag names are encrypted with a nonce derived from the tag, so a tag is
+// always the same directory. base64url never has a slash or leading dot.
+func encodeTag(tag string) (name string, err error) {
+	if !storeEncrypted() {
+		return tag, nil
+	}
+	keys, err := getStoreKeys()
+	if err != nil {
+		return
+	}
+	aead, err := newAEAD(keys.tags)
+	if err != nil {
+		return
+	}
+	nonce := deriveKey(keys.tagNonces, tag)[:aead.NonceSize()]
+	name = base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(tag), nil))
+	return
+}
+
+// encrypted is false for tag names from before the store was encrypted.
+func decryptTag(name string) (tag string, encrypted bool, err error) {
+	tag = name
+	if !storeEncrypted() {
+		return
+	}
+	keys, err := getStoreKeys()
+	if err != nil {
+		return
+	}
+	aead, err := newAEAD(keys.tags)
+	if err != nil {
+		return
+	}
+	sealed, decodeErr := base64.RawURLEncoding.DecodeString(name)
+	if decodeErr != nil || len(sealed) < aead.NonceSize() {
+		return
+	}
+	plaintext, openErr := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if openErr != nil {
+		return
+	}
+	return string(plaintext), true, nil
+}
+
+func decodeTag(name string) (tag string, err error) {
+	tag, _, err = decryptTag(name)
+	return
+}
+
+// Decodes a directory listing of tag names, sorted by what they decode to.
+func decodeTags(names []string) (tags []string, err error) {
+	if !storeEncrypted() {
+		return names, nil
+	}
+	for _, name := range names {
+		tag, err := decodeTag(name)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return
+}
+
+func getTagPath(tag string) (path string, err error) {
+	name, err := encodeTag(tag)
+	path = tagsDir() + "/" + name
+	return
+}
+
+// Moves an asset's bytes, filename and back tags over to their encrypted
+// forms. Safe to run again if it was interrupted.
+func encryptAsset(asset string) (err error) {
+	if !isEncrypted(asset) {
+		reader, err := openAsset(asset)
+		if err != nil {
+			return err
+		}
+		err = encryptAssetFrom(asset, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		// Make sure it comes back out the same before letting go of the plaintext.
+		if err = checkAssetHash(asset); err != nil {
+			os.Remove(getEncryptedPath(asset))
+			return err
+		}
+	}
+	if isChunked(asset) {
+		if err = removeChunked(asset); err != nil {
+			return
+		}
+	}
+	for _, path := range []string{getCompressedPath(asset), getAssetPath(asset), getAssetFilePathGzip(asset)} {
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	filenameByte, err := ioutil.ReadFile(getAssetFilePathFilename(asset))
+	if err == nil {
+		filename := strings.Trim(string(filenameByte), "\n")
+		if !strings.HasPrefix(filename, encryptedFilenamePrefix) {
+			if err = addFilename(asset, filename); err != nil {
+				return
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	names, err := list_directory(getAssetFilePathTags(asset))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	for _, name := range names {
+		if err = encryptTagName(getAssetFilePathTags(asset), name); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Renames a tag file or directory to its encrypted name, merging tag
+// directories if the encrypted one is already there.
+func encryptTagName(directory string, name string) (err error) {
+	_, encrypted, err := decryptTag(name)
+	if err != nil || encrypted {
+		return
+	}
+	encodedName, err := encodeTag(name)
+	if err != nil {
+		return
+	}
+	path := directory + "/" + name
+	encodedPath := directory + "/" + encodedName
+	if _, statErr := os.Stat(encodedPath); statErr != nil {
+		return os.Rename(path, encodedPath)
+	}
+	entries, err := list_directory(path)
+	if err != nil {
+		// A back tag the asset already has under its encrypted name.
+		return os.Remove(path)
+	}
+	for _, entry := range entries {
+		if err = os.Rename(path+"/"+entry, encodedPath+"/"+entry); err != nil {
+			return
+		}
+	}
+	return os.Remove(path)
+}
+
+// Sets up encryption if the store isn't encrypted yet, then encrypts
+// everything that isn't.
+func encryptStore() (err error) {
+	if !storeEncrypted() {
+		passphrase, err := readPassphrase()
+		if err != nil {
+			return err
+		}
+		if err = setupEncryption(passphrase); err != nil {
+			return err
+		}
+	} else if _, err = getStoreKeys(); err != nil {
+		return
+	}
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	for _, asset := range all_assets {
+		if err = encryptAsset(asset); err != nil {
+			return fmt.Errorf("%s: %s", asset, err.Error())
+		}
+	}
+	names, err := list_directory(tagsDir())
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if err = encryptTagName(tagsDir(), name); err != nil {
+			return
+		}
+	}
+	if err = encryptPublished(); err != nil {
+		return
+	}
+	return rewriteJournal(func(entry *journalEntry) (err error) {
+		if entry.Tag == "" {
+			return
+		}
+		if _, encrypted, err := decryptTag(entry.Tag); err != nil || encrypted {
+			return err
+		}
+		entry.Tag, err = encodeTag(entry.Tag)
+		return
+	})
+}
+
+// A signed manifest can't be encrypted, so it goes. The replication report
+// is saved again with its filenames and tags encrypted.
+func encryptPublished() (err error) {
+	for _, path := range []string{manifestPath(), manifestSignaturePath()} {
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	report, err := loadReplicationReport()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	return saveReplicationReport(report)
+}
+
+// Web mode starts locked and listens here for decensor unlock. Only the
+// user running web (before it drops to nobody) can connect.
+func listenForUnlock() (err error) {
+	path := getUnlockSocketPath()
+	// Left over from the last time web ran.
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return
+	}
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				log.Print("Unable to accept unlock connection: ", err.Error())
+				return
+			}
+			go handleUnlock(connection)
+		}
+	}()
+	return
+}
+
+func handleUnlock(connection net.Conn) {
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(time.Minute))
+	line, err := bufio.NewReader(connection).ReadString('\n')
+	if err != nil {
+		log.Print("Unable to read unlock request: ", err.Error())
+		return
+	}
+	if err = unlockStore(strings.TrimRight(line, "\r\n")); err != nil {
+		log.Print("Unlock failed: ", err.Error())
+		fmt.Fprintln(connection, err.Error())
+		return
+	}
+	log.Print("Store unlocked.")
+	fmt.Fprintln(connection, "Unlocked.")
+	// Web mode couldn't hash anything while it was locked.
+	if err := startPrimingAssetHashes(); err != nil {
+		log.Print("Unable to prime asset hashes: ", err.Error())
+	}
+}
+
+// Sends the passphrase to a running decensor web.
+func unlock() (err error) {
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return
+	}
+	connection, err := net.Dial("unix", getUnlockSocketPath())
+	if err != nil {
+		return
+	}
+	defer connection.Close()
+	if _, err = fmt.Fprintln(connection, passphrase); err != nil {
+		return
+	}
+	reply, err := bufio.NewReader(connection).ReadString('\n')
+	if err != nil {
+		return
+	}
+	if reply = strings.TrimRight(reply, "\n"); reply != "Unlocked." {
+		err = errors.New(reply)
+	}
+	return
+}
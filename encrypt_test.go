@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// From RFC 7914, section 11.
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		key        string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, test := range tests {
+		key := hex.EncodeToString(pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations, 64))
+		if key != test.key {
+			t.Errorf("PBKDF2 of %s should be %s, not %s", test.password, test.key, key)
+		}
+	}
+}
+
+func openTestEncryptedAsset(t *testing.T, sealed []byte) (reader *encryptedAsset, err error) {
+	aead, err := newAEAD(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir() + "/encrypted"
+	if err = ioutil.WriteFile(path, sealed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = &encryptedAsset{fd: fd, aead: aead, cachedIndex: -1}
+	reader.size, reader.segments, err = encryptedSize(int64(len(sealed)))
+	return
+}
+
+func TestEncryptedAsset(t *testing.T) {
+	aead, _ := newAEAD(make([]byte, 32))
+	for _, size := range []int{0, 10, encryptedSegmentSize, 150000} {
+		content := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+		var sealed bytes.Buffer
+		if err := sealSegments(aead, bytes.NewReader(content), &sealed); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := openTestEncryptedAsset(t, sealed.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := ioutil.ReadAll(reader)
+		if err != nil || !bytes.Equal(all, content) {
+			t.Errorf("Should read back %d bytes of plaintext: %d %v", size, len(all), err)
+		}
+		if size > encryptedSegmentSize {
+			// Across the segment boundary.
+			offset := int64(encryptedSegmentSize - 5)
+			reader.Seek(offset, io.SeekStart)
+			part := make([]byte, 10)
+			if _, err = io.ReadFull(reader, part); err != nil || !bytes.Equal(part, content[offset:offset+10]) {
+				t.Errorf("Wrong bytes at %d: %q %v", offset, part, err)
+			}
+		}
+		reader.Close()
+	}
+}
+
+func TestEncryptedAssetTampering(t *testing.T) {
+	aead, _ := newAEAD(make([]byte, 32))
+	content := bytes.Repeat([]byte("x"), 2*encryptedSegmentSize)
+	var sealed bytes.Buffer
+	sealSegments(aead, bytes.NewReader(content), &sealed)
+	// Dropping the last segment leaves a first segment that isn't marked last.
+	truncated := sealed.Bytes()[:encryptedSegmentSize+encryptedSegmentTag]
+	reader, err := openTestEncryptedAsset(t, truncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(reader); err == nil {
+		t.Errorf("Truncated asset should not decrypt")
+	}
+	reader.Close()
+	flipped := append([]byte{}, sealed.Bytes()...)
+	flipped[100] ^= 1
+	if reader, err = openTestEncryptedAsset(t, flipped); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(reader); err == nil {
+		t.Errorf("Modified asset should not decrypt")
+	}
+	reader.Close()
+	if _, _, err = encryptedSize(encryptedSegmentTag - 1); err == nil {
+		t.Errorf("Too short to be an encrypted asset")
+	}
+}
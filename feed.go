@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How many of the most recently added assets a feed lists.
+const feedEntries = 50
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Links      []atomLink     `xml:"link"`
+	Summary    string         `xml:"summary"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// Absolute URL of the site root with a trailing slash. Feeds need absolute links.
+func siteURL(r *http.Request) string {
+	if baseURL := getBaseURL(); baseURL != "" {
+		return baseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if forwardedProto := r.Header.Get("X-Forwarded-Proto"); forwardedProto == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/"
+}
+
+type assetAddedAt struct {
+	asset   string
+	addedAt time.Time
+}
+
+// Returns up to limit assets, newest first.
+func newestAssets(assets []string, limit int) (newest []assetAddedAt) {
+	for _, asset := range assets {
+		addedAt, err := getAssetAddedAt(asset)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		newest = append(newest, assetAddedAt{asset: asset, addedAt: addedAt})
+	}
+	sort.SliceStable(newest, func(i, j int) bool {
+		return newest[i].addedAt.After(newest[j].addedAt)
+	})
+	if len(newest) > limit {
+		newest = newest[:limit]
+	}
+	return
+}
+
+func atomFeedXML(assets []string, title string, feedURL string, pageURL string, root string) (output string, err error) {
+	feed := atomFeed{Title: title,
+		ID:      feedURL,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links: []atomLink{{Rel: "self", Href: feedURL, Type: "application/atom+xml"},
+			{Rel: "alternate", Href: pageURL, Type: "text/html"}}}
+	newest := newestAssets(assets, feedEntries)
+	if len(newest) != 0 {
+		feed.Updated = newest[0].addedAt.UTC().Format(time.RFC3339)
+	}
+	for _, item := range newest {
+		size, err := getAssetSize(item.asset)
+		if err != nil {
+			return output, err
+		}
+		// Assets named by other multihashes still get a SHA256 URN.
+		checksum, err := getAssetChecksum(item.asset, "sha256")
+		if err != nil {
+			return output, err
+		}
+		mimeType := getAssetMimeType(item.asset)
+		entry := atomEntry{Title: getAssetFilename(item.asset),
+			ID:      "urn:sha256:" + checksum,
+			Updated: item.addedAt.UTC().Format(time.RFC3339),
+			Links: []atomLink{{Rel: "alternate", Href: root + "info/" + item.asset, Type: "text/html"},
+				{Rel: "enclosure", Href: root + "asset/" + item.asset, Type: mimeType, Length: size}},
+			Summary: fmt.Sprintf("Size: %d bytes, Mime Type: %s, SHA256: %s", size, mimeType, checksum)}
+		for _, tag := range tags_by_asset(item.asset) {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	feedXML, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return
+	}
+	output = xml.Header + string(feedXML) + "\n"
+	return
+}
+
+// /feed.atom for the whole store, /tag/<tag>/feed.atom for one tag.
+func httpFeed(w http.ResponseWriter, r *http.Request, tag string) {
+	var feedAssets []string
+	var err error
+	root := siteURL(r)
+	title := getSettingOrDefault("site_title")
+	pageURL := root
+	if tag == "" {
+		feedAssets, err = assets()
+	} else {
+		if has_dot(tag) {
+			http.Error(w, ".'s not allowed.", http.StatusBadRequest)
+			return
+		}
+		feedAssets, err = assets_by_tag(tag)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "No such tag found.", http.StatusNotFound)
+			return
+		}
+		title += ": " + tag
+		pageURL = root + "tag/" + tag
+	}
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	if httpNotModified(w, r) {
+		return
+	}
+	output, err := atomFeedXML(feedAssets, title, root+strings.TrimPrefix(r.URL.Path, "/"), pageURL, root)
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	_, err = io.WriteString(w, output)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+}
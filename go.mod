@@ -1,5 +1,5 @@
 module github.com/teran-mckinney/decensor
 
-go 1.12
+go 1.17
 
 require gopkg.in/alexcesaro/statsd.v2 v2.0.0
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CIDv1 as `ipfs add --cid-version=1` computes it with the defaults:
+// 256 KiB fixed size chunks, raw leaves, balanced DAG with at most 174 links
+// per node, SHA2-256. No IPFS daemon needed.
+
+const ipfsChunkSize = 256 * 1024
+const ipfsMaxLinks = 174
+
+// Multicodec codes.
+const ipfsCodecRaw = 0x55
+const ipfsCodecDagPB = 0x70
+const ipfsMultihashSHA256 = 0x12
+
+// UnixFS Data.Type for files.
+const unixfsTypeFile = 2
+
+var ipfsBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type ipfsNode struct {
+	cid      []byte
+	fileSize uint64
+	// Cumulative size of the node and everything under it.
+	treeSize uint64
+}
+
+func appendVarint(buffer []byte, value uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	return append(buffer, varint[:binary.PutUvarint(varint[:], value)]...)
+}
+
+func ipfsCID(codec uint64, content []byte) []byte {
+	digest := sha256.Sum256(content)
+	cid := appendVarint([]byte{1}, codec)
+	cid = append(cid, ipfsMultihashSHA256, sha256.Size)
+	return append(cid, digest[:]...)
+}
+
+func ipfsCIDString(cid []byte) string {
+	// Multibase prefix b is lowercase base32.
+	return "b" + strings.ToLower(ipfsBase32.EncodeToString(cid))
+}
+
+// dag-pb node with UnixFS file data linking to children.
+func ipfsParentNode(children []ipfsNode) ipfsNode {
+	var unixfs []byte
+	var fileSize, treeSize uint64
+	for _, child := range children {
+		fileSize += child.fileSize
+	}
+	unixfs = append(unixfs, 0x08, unixfsTypeFile)
+	unixfs = append(unixfs, 0x18)
+	unixfs = appendVarint(unixfs, fileSize)
+	for _, child := range children {
+		unixfs = append(unixfs, 0x20)
+		unixfs = appendVarint(unixfs, child.fileSize)
+	}
+	// Links (field 2) come before Data (field 1) in dag-pb.
+	var node []byte
+	for _, child := range children {
+		var link []byte
+		link = append(link, 0x0a)
+		link = appendVarint(link, uint64(len(child.cid)))
+		link = append(link, child.cid...)
+		// go-ipfs always writes the empty Name.
+		link = append(link, 0x12, 0x00)
+		link = append(link, 0x18)
+		link = appendVarint(link, child.treeSize)
+		node = append(node, 0x12)
+		node = appendVarint(node, uint64(len(link)))
+		node = append(node, link...)
+		treeSize += child.treeSize
+	}
+	node = append(node, 0x0a)
+	node = appendVarint(node, uint64(len(unixfs)))
+	node = append(node, unixfs...)
+	return ipfsNode{cid: ipfsCID(ipfsCodecDagPB, node),
+		fileSize: fileSize,
+		treeSize: treeSize + uint64(len(node))}
+}
+
+func computeIPFSCID(reader io.Reader) (cid string, err error) {
+	var leaves []ipfsNode
+	chunk := make([]byte, ipfsChunkSize)
+	for {
+		n, readErr := io.ReadFull(reader, chunk)
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil && readErr != io.ErrUnexpectedEOF {
+			return cid, readErr
+		}
+		leaves = append(leaves, ipfsNode{cid: ipfsCID(ipfsCodecRaw, chunk[:n]),
+			fileSize: uint64(n),
+			treeSize: uint64(n)})
+		if n < ipfsChunkSize {
+			break
+		}
+	}
+	if len(leaves) == 0 {
+		// Empty files are a single empty raw block.
+		return ipfsCIDString(ipfsCID(ipfsCodecRaw, nil)), nil
+	}
+	// Balanced layout: group into parents until only the root is left.
+	layer := leaves
+	for len(layer) > 1 {
+		var parents []ipfsNode
+		for start := 0; start < len(layer); start += ipfsMaxLinks {
+			end := start + ipfsMaxLinks
+			if end > len(layer) {
+				end = len(layer)
+			}
+			parents = append(parents, ipfsParentNode(layer[start:end]))
+		}
+		layer = parents
+	}
+	return ipfsCIDString(layer[0].cid), nil
+}
+
+func getAssetFilePathCID(asset string) string {
+	return metadataDir() + "/" + asset + "/cid"
+}
+
+var cidCache = make(map[string]string)
+var cidCacheLock sync.Mutex
+
+// Stored in metadata when the asset is added. Computed (and cached if we
+// can write) for assets from before that.
+func getAssetCID(asset string) (cid string, err error) {
+	cidCacheLock.Lock()
+	cid, ok := cidCache[asset]
+	cidCacheLock.Unlock()
+	if ok {
+		return
+	}
+	cidByte, err := ioutil.ReadFile(getAssetFilePathCID(asset))
+	if err == nil {
+		cid = strings.Trim(string(cidByte), "\n")
+	} else if !hashOnDemand(asset) {
+		return "", errNotHashed
+	} else {
+		return hashCID(asset)
+	}
+	cidCacheLock.Lock()
+	cidCache[asset] = cid
+	cidCacheLock.Unlock()
+	return
+}
+
+// Computes the CID, recording it in metadata if we can and in memory.
+func hashCID(asset string) (cid string, err error) {
+	if cid, err = addCID(asset); err != nil {
+		return
+	}
+	cidCacheLock.Lock()
+	cidCache[asset] = cid
+	cidCacheLock.Unlock()
+	return
+}
+
+// Computes and stores the CID. Not being able to store it isn't fatal.
+func addCID(asset string) (cid string, err error) {
+	fd, err := openAsset(asset)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	if cid, err = computeIPFSCID(fd); err != nil {
+		return
+	}
+	writeErr := init_metadata(asset)
+	if writeErr == nil {
+		writeErr = ioutil.WriteFile(getAssetFilePathCID(asset), []byte(cid+"\n"), 0644)
+	}
+	if writeErr != nil {
+		log.Printf("Unable to store CID for %s: %s", asset, writeErr.Error())
+	}
+	return
+}
+
+func assetByCID(cid string) (asset string, err error) {
+	cid = strings.ToLower(cid)
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	for _, possible_asset := range all_assets {
+		possible_cid, err := getAssetCID(possible_asset)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if possible_cid == cid {
+			return possible_asset, nil
+		}
+	}
+	err = errors.New("No asset with that CID.")
+	return
+}
+
+// Lists "<cid> <asset>" for every asset, computing any that are missing.
+func cids() (output []string, err error) {
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	for _, asset := range all_assets {
+		cid, err := getAssetCID(asset)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, cid+" "+asset)
+	}
+	return
+}
+
+// /cid/<cid> redirects to the asset's permalink.
+func httpCID(w http.ResponseWriter, r *http.Request) {
+	cid := strings.TrimPrefix(r.URL.Path, "/cid/")
+	if !strings.HasPrefix(cid, "b") || strings.Contains(cid, "/") {
+		http.Error(w, "Only base32 CIDv1 (starting with b) are supported.", http.StatusBadRequest)
+		return
+	}
+	asset, err := assetByCID(cid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, "../info/"+asset, http.StatusFound)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestComputeIPFSCID(t *testing.T) {
+	// Checked against `ipfs add --cid-version=1`.
+	cases := map[string]string{
+		"":              "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku",
+		"hello world\n": "bafkreifjjcie6lypi6ny7amxnfftagclbuxndqonfipmb64f2km2devei4",
+	}
+	for content, expected := range cases {
+		cid, err := computeIPFSCID(bytes.NewReader([]byte(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cid != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, content, cid)
+		}
+	}
+}
+
+func TestComputeIPFSCIDMultiChunk(t *testing.T) {
+	// Checked against `ipfs add --cid-version=1 --raw-leaves` from kubo 0.30.0.
+	// Two chunks under one dag-pb node, then 176 chunks, which takes a
+	// second layer since a node links to at most 174.
+	cases := map[int]string{
+		300000:                "bafybeibwhwmfm4xpsvyqyikduvij35b2ttcbm5esjhi7p5ra7rb56e32sm",
+		175*ipfsChunkSize + 7: "bafybeih64cz5vlywlid7mzo4tn7mhzzfj2ugdtnwgswxbxckbvsryxs7wu",
+	}
+	for size, expected := range cases {
+		content := bytes.Repeat([]byte("decensor\n"), size/9+1)[:size]
+		cid, err := computeIPFSCID(bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cid != expected {
+			t.Errorf("Expected %s for %d bytes, got %s", expected, size, cid)
+		}
+	}
+}
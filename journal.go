@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Every change to the store is appended to journalPath() as a line of JSON
+// with a sequence number, so peers and indexers can ask for what changed
+// since the last sequence number they saw instead of comparing everything.
+
+// Most changes /changes returns at once. Ask again with the last sequence number for more.
+const changesPageSize = 1000
+
+type journalEntry struct {
+	Seq   int64  `json:"seq"`
+	Time  string `json:"time"`
+	Op    string `json:"op"`
+	Asset string `json:"asset,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+type changesPage struct {
+	// Newest sequence number in the journal.
+	Latest  int64          `json:"latest"`
+	More    bool           `json:"more"`
+	Changes []journalEntry `json:"changes"`
+}
+
+func journalPath() string {
+	return baseDir() + "/journal"
+}
+
+// rewriteJournal replaces the journal, so locking the journal itself would
+// leave appends locking the old one. Everything that writes it takes this.
+func journalLockPath() string {
+	return journalPath() + ".lock"
+}
+
+// Returns the open lock file, closing it unlocks.
+func lockJournal() (lock *os.File, err error) {
+	lock, err = os.OpenFile(journalLockPath(), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return
+}
+
+// Reads the sequence number of the last entry, without reading the whole journal.
+func lastJournalSeq(fd *os.File) (seq int64, err error) {
+	stat, err := fd.Stat()
+	if err != nil || stat.Size() == 0 {
+		return
+	}
+	offset := stat.Size() - 64*1024
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, stat.Size()-offset)
+	if _, err = fd.ReadAt(tail, offset); err != nil {
+		return
+	}
+	tail = bytes.TrimRight(tail, "\n")
+	line := tail[bytes.LastIndexByte(tail, '\n')+1:]
+	var entry journalEntry
+	if err = json.Unmarshal(line, &entry); err != nil {
+		err = errors.New("Journal is corrupt: " + err.Error())
+		return
+	}
+	seq = entry.Seq
+	return
+}
+
+// 0 if there's no journal yet.
+func latestJournalSeq() (seq int64, err error) {
+	fd, err := os.Open(journalPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return
+	}
+	defer fd.Close()
+	return lastJournalSeq(fd)
+}
+
+func journal(entry journalEntry) (err error) {
+	// replicate and the command line can both be changing the store.
+	lock, err := lockJournal()
+	if err != nil {
+		return
+	}
+	defer lock.Close()
+	fd, err := os.OpenFile(journalPath(), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	last, err := lastJournalSeq(fd)
+	if err != nil {
+		return
+	}
+	entry.Seq = last + 1
+	entry.Time = time.Now().UTC().Format(time.RFC3339)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	_, err = fd.Write(append(line, '\n'))
+	return
+}
+
+func journalAsset(op string, asset string) error {
+	return journal(journalEntry{Op: op, Asset: asset})
+}
+
+func journalTag(asset string, tag string) error {
+	// Encrypted stores keep tag names encrypted in the journal too.
+	name, err := encodeTag(tag)
+	if err != nil {
+		return err
+	}
+	return journal(journalEntry{Op: "tag", Asset: asset, Tag: name})
+}
+
+func journalMetadata(asset string, name string, value string) error {
+	return journal(journalEntry{Op: "metadata", Asset: asset, Name: name, Value: value})
+}
+
+// Returns up to limit entries after since, and the newest sequence number.
+func journalSince(since int64, limit int) (page changesPage, err error) {
+	page.Changes = []journalEntry{}
+	fd, err := os.Open(journalPath())
+	if os.IsNotExist(err) {
+		// Nothing has changed since we started keeping a journal.
+		return page, nil
+	}
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return
+		}
+		page.Latest = entry.Seq
+		if entry.Seq <= since {
+			continue
+		}
+		if limit > 0 && len(page.Changes) >= limit {
+			page.More = true
+			continue
+		}
+		if entry.Tag != "" {
+			if entry.Tag, err = decodeTag(entry.Tag); err != nil {
+				return
+			}
+		}
+		page.Changes = append(page.Changes, entry)
+	}
+	err = scanner.Err()
+	return
+}
+
+// Changes entries in place, for when what the journal records changes form.
+func rewriteJournal(change func(entry *journalEntry) error) (err error) {
+	lock, err := lockJournal()
+	if err != nil {
+		return
+	}
+	defer lock.Close()
+	fd, err := os.Open(journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	var rewritten bytes.Buffer
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return
+		}
+		if err = change(&entry); err != nil {
+			return
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		rewritten.Write(append(line, '\n'))
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(journalPath()+".tmp", rewritten.Bytes(), 0644); err != nil {
+		return
+	}
+	return os.Rename(journalPath()+".tmp", journalPath())
+}
+
+func formatJournalEntry(entry journalEntry) string {
+	line := fmt.Sprintf("%d %s %s", entry.Seq, entry.Time, entry.Op)
+	if entry.Asset != "" {
+		line += " " + entry.Asset
+	}
+	if entry.Tag != "" {
+		line += " " + entry.Tag
+	}
+	if entry.Name != "" {
+		line += " " + entry.Name + "=" + entry.Value
+	}
+	return line
+}
+
+func journalLog(since int64) (output []string, err error) {
+	page, err := journalSince(since, 0)
+	if err != nil {
+		return
+	}
+	for _, entry := range page.Changes {
+		output = append(output, formatJournalEntry(entry))
+	}
+	return
+}
+
+func parseSince(since string) (seq int64, err error) {
+	if since == "" {
+		return
+	}
+	seq, err = strconv.ParseInt(since, 10, 64)
+	if err != nil || seq < 0 {
+		err = errors.New("Since must be a sequence number.")
+	}
+	return
+}
+
+func httpChanges(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		httpHandle400(w, err)
+		return
+	}
+	// Only the journal matters here, settings and templates don't change it.
+	if stat, err := os.Stat(journalPath()); err == nil {
+		etag := fmt.Sprintf("W/\"%x-%x-%d\"", stat.Size(), stat.ModTime().UnixNano(), since)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", revalidateCacheControl)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	page, err := journalSince(since, changesPageSize)
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	output, err := json.Marshal(page)
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(append(output, '\n')); err != nil {
+		log.Print(err)
+	}
+}
+
+// Asks a peer for its newest sequence number. Peers from before the
+// journal existed return an error.
+func fetchLatestSeq(root string, since int64) (latest int64, err error) {
+	body, err := httpGet(root + "changes?since=" + strconv.FormatInt(since, 10))
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	var page changesPage
+	if err = json.NewDecoder(io.LimitReader(body, 64*1024*1024)).Decode(&page); err != nil {
+		return
+	}
+	latest = page.Latest
+	return
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestLastJournalSeq(t *testing.T) {
+	fd, err := ioutil.TempFile("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+	seq, err := lastJournalSeq(fd)
+	if err != nil || seq != 0 {
+		t.Errorf("Empty journal should be at 0, got %d %v", seq, err)
+	}
+	fd.WriteString(`{"seq":1,"time":"2019-07-15T00:00:00Z","op":"add","asset":"a"}` + "\n")
+	fd.WriteString(`{"seq":2,"time":"2019-07-15T00:00:00Z","op":"tag","asset":"a","tag":"foo"}` + "\n")
+	seq, err = lastJournalSeq(fd)
+	if err != nil || seq != 2 {
+		t.Errorf("Expected 2, got %d %v", seq, err)
+	}
+}
+
+func TestFormatJournalEntry(t *testing.T) {
+	entry := journalEntry{Seq: 4, Time: "2019-07-15T00:00:00Z", Op: "metadata", Asset: "a", Name: "mime", Value: "text/plain"}
+	expected := "4 2019-07-15T00:00:00Z metadata a mime=text/plain"
+	if formatJournalEntry(entry) != expected {
+		t.Errorf("Expected %s, got %s", expected, formatJournalEntry(entry))
+	}
+}
+
+func TestRewriteJournalKeepsConcurrentEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("DECENSOR_DIR", dir)
+	var waitGroup sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := 0; i < 500; i++ {
+				if err := journalAsset("add", "a"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	done := make(chan bool)
+	go func() {
+		waitGroup.Wait()
+		close(done)
+	}()
+	// Rewrite for as long as the writers are appending.
+	for rewriting := true; rewriting; {
+		select {
+		case <-done:
+			rewriting = false
+		default:
+			err := rewriteJournal(func(entry *journalEntry) error {
+				entry.Asset = "b"
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	page, err := journalSince(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Changes) != 2000 {
+		t.Errorf("Expected 2000 entries, got %d", len(page.Changes))
+	}
+	for index, entry := range page.Changes {
+		if entry.Seq != int64(index+1) {
+			t.Errorf("Expected seq %d, got %d", index+1, entry.Seq)
+			break
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 )
 
 func exactly_arguments(arguments int) {
@@ -11,6 +12,16 @@ func exactly_arguments(arguments int) {
 	}
 }
 
+// Asset arguments can be legacy hex, hex multihash or base58 multihash.
+func asset_argument(index int) string {
+	asset, err := resolveAsset(os.Args[index])
+	if err != nil {
+		// Let the command itself complain about it.
+		return os.Args[index]
+	}
+	return asset
+}
+
 func print_list(list []string) {
 	for _, item := range list {
 		fmt.Println(item)
@@ -22,16 +33,54 @@ func usage() {
 	fmt.Fprintln(os.Stderr, "Command: init")
 	fmt.Fprintln(os.Stderr, "Command: back_tag_all_assets")
 	fmt.Fprintln(os.Stderr, "Command: basedir")
-	fmt.Fprintln(os.Stderr, "Command: hash <file to hash>")
-	fmt.Fprintln(os.Stderr, "Command: web <port> (Example: :4444)")
+	fmt.Fprintln(os.Stderr, "Command: hash <file to hash> (Uses the hash_algorithm setting.)")
+	fmt.Fprintln(os.Stderr, "Command: lookup <md5, sha1, sha256 or multihash> (Finds assets by checksum.)")
+	fmt.Fprintln(os.Stderr, "Command: web <port> [template directory] (Example: :4444)")
 	fmt.Fprintln(os.Stderr, "Command: info <asset>")
 	fmt.Fprintln(os.Stderr, "Command: assets")
 	fmt.Fprintln(os.Stderr, "Command: assets_by_tag <tag>")
+	fmt.Fprintln(os.Stderr, "Command: export_tag <tag> <zip|tar> (Writes to stdout.)")
+	fmt.Fprintln(os.Stderr, "Command: torrent <asset|tag> (Writes a .torrent to stdout. Set base_url for a web seed.)")
+	fmt.Fprintln(os.Stderr, "Command: magnet <asset|tag>")
+	fmt.Fprintln(os.Stderr, "Command: cids (Lists IPFS CIDs, computing any that are missing.)")
 	fmt.Fprintln(os.Stderr, "Command: tags_by_asset <asset>")
+	fmt.Fprintln(os.Stderr, "Command: mimes")
+	fmt.Fprintln(os.Stderr, "Command: assets_by_mime <mime type or major> (Example: video/mp4 or video)")
 	fmt.Fprintln(os.Stderr, "Command: tags")
 	fmt.Fprintln(os.Stderr, "Command: tag <asset> <tag> <tag> <tag>...")
 	fmt.Fprintln(os.Stderr, "Command: metadata_by_asset <asset>")
+	fmt.Fprintln(os.Stderr, "Command: settings")
+	fmt.Fprintln(os.Stderr, "Command: set_setting <name> <value> (Empty value to unset. Example: theme_css <asset>)")
+	fmt.Fprintln(os.Stderr, "Command: set_mime <asset> <mime type>")
 	fmt.Fprintln(os.Stderr, "Command: validate_assets")
+	fmt.Fprintln(os.Stderr, "Command: scrub [max age in hours] (Rehashes assets in parallel, only those not verified within max age if given.)")
+	fmt.Fprintln(os.Stderr, "Command: doctor [--fix] (Finds orphaned metadata, dangling and empty tags, leftover copies and temporary files.)")
+	fmt.Fprintln(os.Stderr, "Command: log [--since <sequence number>] (Changes to the store, oldest first.)")
+	fmt.Fprintln(os.Stderr, "Command: keygen (Creates the ed25519 key for signing manifests.)")
+	fmt.Fprintln(os.Stderr, "Command: sign (Writes a signed manifest, served at /manifest and /manifest.sig.)")
+	fmt.Fprintln(os.Stderr, "Command: verify_manifest <manifest URL or file> <public key> (Example: https://example.com/manifest)")
+	fmt.Fprintln(os.Stderr, "Command: trust <public key> <name> (Adds a publisher to the keyring.)")
+	fmt.Fprintln(os.Stderr, "Command: untrust <public key>")
+	fmt.Fprintln(os.Stderr, "Command: trusted")
+	fmt.Fprintln(os.Stderr, "Command: sync <mirror URL> [quarantine] (Imports from a trusted publisher's manifest, quarantines the rest if asked.)")
+	fmt.Fprintln(os.Stderr, "Command: peers <add|remove> <url>")
+	fmt.Fprintln(os.Stderr, "Command: peers list")
+	fmt.Fprintln(os.Stderr, "Command: replicate [interval in seconds] (Syncs from every peer forever, 300 seconds apart by default.)")
+	fmt.Fprintln(os.Stderr, "Command: replication_report [minimum copies] (Assets with fewer copies across us and our peers, 2 by default.)")
+	fmt.Fprintln(os.Stderr, "Command: push_token (Creates the token others need to push here.)")
+	fmt.Fprintln(os.Stderr, "Command: receive <port> (Accepts pushes and uploads, for when web runs as root. Example: :4445)")
+	fmt.Fprintln(os.Stderr, "Command: upload <url> <path to file> [tag...] (Resumable, using DECENSOR_PUSH_TOKEN.)")
+	fmt.Fprintln(os.Stderr, "Command: push <url> [tag...] (Uploads assets the remote lacks, using DECENSOR_PUSH_TOKEN.)")
+	fmt.Fprintln(os.Stderr, "Command: quarantined")
+	fmt.Fprintln(os.Stderr, "Command: release <asset> (Moves a quarantined asset into the store.)")
+	fmt.Fprintln(os.Stderr, "Command: reject <asset> (Deletes a quarantined asset.)")
+	fmt.Fprintln(os.Stderr, "Command: chunk [asset] (Moves assets into the chunk store, all of them if no asset given.)")
+	fmt.Fprintln(os.Stderr, "Command: unchunk [asset] (Moves assets out of the chunk store, all of them if no asset given.)")
+	fmt.Fprintln(os.Stderr, "Command: compress [asset] (Gzips textual assets in the store when it saves space, all of them if no asset given.)")
+	fmt.Fprintln(os.Stderr, "Command: uncompress [asset] (Turns compressed assets back into plain files, all of them if no asset given.)")
+	fmt.Fprintln(os.Stderr, "Command: precompress [asset] (All textual assets if no asset given.)")
+	fmt.Fprintln(os.Stderr, "Command: encrypt (Encrypts the store with a passphrase from DECENSOR_PASSPHRASE or stdin.)")
+	fmt.Fprintln(os.Stderr, "Command: unlock (Sends the passphrase to decensor web running on an encrypted store.)")
 	fmt.Fprintln(os.Stderr, "Command: add <path to file>")
 	fmt.Fprintln(os.Stderr, "Command: add_and_tag <path to file> <tag> <tag> <tag>...")
 	fmt.Fprintln(os.Stderr, "Command: remove <asset>")
@@ -52,8 +101,12 @@ func main() {
 		exactly_arguments(2)
 		fmt.Println(baseDir())
 	case "web":
-		exactly_arguments(3)
-		web(os.Args[2])
+		if len(os.Args) == 3 {
+			web(os.Args[2], "")
+		} else {
+			exactly_arguments(4)
+			web(os.Args[2], os.Args[3])
+		}
 	case "hash":
 		exactly_arguments(3)
 		var hash string
@@ -68,10 +121,193 @@ func main() {
 		fmt.Println(asset_hash)
 	case "remove":
 		exactly_arguments(3)
-		fatal_error(remove(os.Args[2]))
+		fatal_error(remove(asset_argument(2)))
 	case "validate_assets":
 		exactly_arguments(2)
 		fatal_error(validate_assets())
+	case "scrub":
+		var maxAge time.Duration
+		if len(os.Args) == 3 {
+			maxAge, err = parseScrubMaxAge(os.Args[2])
+			fatal_error(err)
+		} else {
+			exactly_arguments(2)
+		}
+		result, err := scrub(maxAge)
+		for _, problem := range result.Problems {
+			fmt.Println(problem.String())
+		}
+		fatal_error(err)
+		fmt.Printf("Scrubbed %d assets, skipped %d verified recently, found %d problems.\n", result.Checked, result.Skipped, len(result.Problems))
+		if len(result.Problems) != 0 {
+			os.Exit(1)
+		}
+	case "doctor":
+		fix := len(os.Args) == 3 && os.Args[2] == "--fix"
+		if !fix {
+			exactly_arguments(2)
+		}
+		problems, err := doctor(fix)
+		for _, problem := range problems {
+			fmt.Println(problem.String())
+		}
+		fatal_error(err)
+		if fix {
+			fmt.Printf("Fixed %d problems.\n", len(problems))
+		} else if len(problems) != 0 {
+			fmt.Fprintf(os.Stderr, "Found %d problems, doctor --fix repairs them.\n", len(problems))
+			os.Exit(1)
+		}
+	case "log":
+		var since int64
+		if len(os.Args) == 4 && os.Args[2] == "--since" {
+			since, err = parseSince(os.Args[3])
+			fatal_error(err)
+		} else {
+			exactly_arguments(2)
+		}
+		entries, err := journalLog(since)
+		fatal_error(err)
+		print_list(entries)
+	case "keygen":
+		exactly_arguments(2)
+		publicKey, err := keygen()
+		fatal_error(err)
+		fmt.Println(publicKey)
+	case "sign":
+		exactly_arguments(2)
+		fatal_error(sign())
+	case "verify_manifest":
+		exactly_arguments(4)
+		verified, err := verifyManifest(os.Args[2], os.Args[3])
+		fatal_error(err)
+		fmt.Printf("Manifest signature and all %d assets verified.\n", verified)
+	case "trust":
+		exactly_arguments(4)
+		fatal_error(trust(os.Args[2], os.Args[3]))
+	case "untrust":
+		exactly_arguments(3)
+		fatal_error(untrust(os.Args[2]))
+	case "trusted":
+		exactly_arguments(2)
+		publishers, err := trusted()
+		fatal_error(err)
+		print_list(publishers)
+	case "sync":
+		quarantine := false
+		if len(os.Args) == 4 && os.Args[3] == "quarantine" {
+			quarantine = true
+		} else {
+			exactly_arguments(3)
+		}
+		result, err := syncFromMirror(os.Args[2], quarantine)
+		fmt.Printf("%d of %d assets synced.\n", result.Synced, result.Assets)
+		fatal_error(err)
+	case "peers":
+		if len(os.Args) <= 2 {
+			usage()
+		}
+		switch os.Args[2] {
+		case "add":
+			exactly_arguments(4)
+			fatal_error(addPeer(os.Args[3]))
+		case "remove":
+			exactly_arguments(4)
+			fatal_error(removePeer(os.Args[3]))
+		case "list":
+			exactly_arguments(3)
+			statuses, err := peers()
+			fatal_error(err)
+			print_list(peersListing(statuses))
+		default:
+			usage()
+		}
+	case "replicate":
+		interval := defaultReplicateInterval
+		if len(os.Args) == 3 {
+			interval, err = parseReplicateInterval(os.Args[2])
+			fatal_error(err)
+		} else {
+			exactly_arguments(2)
+		}
+		replicate(interval)
+	case "replication_report":
+		minimumCopies := defaultMinimumCopies
+		if len(os.Args) == 3 {
+			minimumCopies, err = parseMinimumCopies(os.Args[2])
+			fatal_error(err)
+		} else {
+			exactly_arguments(2)
+		}
+		report, err := replicationReportCommand(minimumCopies)
+		fatal_error(err)
+		print_list(report)
+	case "push_token":
+		exactly_arguments(2)
+		token, err := pushToken()
+		fatal_error(err)
+		fmt.Println(token)
+	case "receive":
+		exactly_arguments(3)
+		receive(os.Args[2])
+	case "push":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		result, err := push(os.Args[2], os.Args[3:])
+		fmt.Printf("%d of %d assets were missing, pushed %d.\n", result.Missing, result.Assets, result.Pushed)
+		fatal_error(err)
+	case "upload":
+		if len(os.Args) < 4 {
+			usage()
+		}
+		asset, err := upload(os.Args[2], os.Args[3], os.Args[4:])
+		fatal_error(err)
+		fmt.Println(asset)
+	case "quarantined":
+		exactly_arguments(2)
+		quarantined_assets, err := quarantined()
+		fatal_error(err)
+		print_list(quarantined_assets)
+	case "release":
+		exactly_arguments(3)
+		fatal_error(release(asset_argument(2)))
+	case "reject":
+		exactly_arguments(3)
+		fatal_error(reject(asset_argument(2)))
+	case "chunk", "unchunk":
+		asset := ""
+		if len(os.Args) == 3 {
+			asset = asset_argument(2)
+		} else {
+			exactly_arguments(2)
+		}
+		fatal_error(chunkAssets(asset, os.Args[1] == "chunk"))
+	case "compress", "uncompress":
+		asset := ""
+		if len(os.Args) == 3 {
+			asset = asset_argument(2)
+		} else {
+			exactly_arguments(2)
+		}
+		fatal_error(compressAssets(asset, os.Args[1] == "compress"))
+	case "precompress":
+		if len(os.Args) == 2 {
+			fatal_error(precompressAll())
+		} else {
+			exactly_arguments(3)
+			saved, err := precompress(asset_argument(2))
+			fatal_error(err)
+			if !saved {
+				fmt.Fprintln(os.Stderr, "Asset is not textual or does not compress well, skipped.")
+			}
+		}
+	case "encrypt":
+		exactly_arguments(2)
+		fatal_error(encryptStore())
+	case "unlock":
+		exactly_arguments(2)
+		fatal_error(unlock())
 	case "back_tag_all_assets":
 		exactly_arguments(2)
 		fatal_error(back_tag_all_assets())
@@ -84,7 +320,7 @@ func main() {
 		if len(os.Args) <= 3 {
 			usage()
 		}
-		err = tag(os.Args[2], os.Args[3:])
+		err = tag(asset_argument(2), os.Args[3:])
 		fatal_error(err)
 	case "add_and_tag":
 		if len(os.Args) <= 3 {
@@ -105,15 +341,60 @@ func main() {
 		tag_assets, err := assets_by_tag(os.Args[2])
 		fatal_error(err)
 		print_list(tag_assets)
+	case "mimes":
+		exactly_arguments(2)
+		all_mimes, err := getFullMimeTypes()
+		fatal_error(err)
+		for _, mimeType := range sortedMimeTypes(all_mimes) {
+			fmt.Printf("%s %d\n", mimeType, all_mimes[mimeType])
+		}
+	case "assets_by_mime":
+		exactly_arguments(3)
+		mime_assets, err := getAssetsByMimeType(os.Args[2])
+		fatal_error(err)
+		print_list(mime_assets)
+	case "export_tag":
+		exactly_arguments(4)
+		fatal_error(exportTag(os.Stdout, os.Args[2], os.Args[3]))
+	case "torrent":
+		exactly_arguments(3)
+		t, err := assetOrTagTorrent(os.Args[2], getBaseURL())
+		fatal_error(err)
+		_, err = os.Stdout.Write(t.Metainfo)
+		fatal_error(err)
+	case "magnet":
+		exactly_arguments(3)
+		t, err := assetOrTagTorrent(os.Args[2], getBaseURL())
+		fatal_error(err)
+		fmt.Println(t.magnet())
+	case "lookup":
+		exactly_arguments(3)
+		matches, err := lookup(os.Args[2])
+		fatal_error(err)
+		print_list(matches)
+	case "cids":
+		exactly_arguments(2)
+		all_cids, err := cids()
+		fatal_error(err)
+		print_list(all_cids)
 	case "tags_by_asset":
 		exactly_arguments(3)
 		var tags []string
-		tags = tags_by_asset(os.Args[2])
+		tags = tags_by_asset(asset_argument(2))
 		print_list(tags)
+	case "set_mime":
+		exactly_arguments(4)
+		fatal_error(setAssetMimeType(asset_argument(2), os.Args[3]))
+	case "settings":
+		exactly_arguments(2)
+		print_list(settings())
+	case "set_setting":
+		exactly_arguments(4)
+		fatal_error(setSetting(os.Args[2], os.Args[3]))
 	case "info":
 		exactly_arguments(3)
 		var infotext string
-		infotext = info(os.Args[2])
+		infotext = info(asset_argument(2))
 		fmt.Println(infotext)
 	default:
 		usage()
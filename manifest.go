@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A signed manifest lists every asset with its filename and tags, so anyone
+// with our public key can check that a mirror is serving what we published.
+// `decensor sign` writes the manifest and its signature into the store, web
+// mode only serves them. The private key never has to be on a mirror.
+
+type manifestAsset struct {
+	Asset    string   `json:"asset"`
+	Filename string   `json:"filename"`
+	Size     int64    `json:"size"`
+	Tags     []string `json:"tags"`
+}
+
+type signedManifest struct {
+	Created   string          `json:"created"`
+	PublicKey string          `json:"public_key"`
+	Assets    []manifestAsset `json:"assets"`
+}
+
+func keysDir() string {
+	return baseDir() + "/keys"
+}
+
+func getPrivateKeyPath() string {
+	return keysDir() + "/private_key"
+}
+
+func getPublicKeyPath() string {
+	return keysDir() + "/public_key"
+}
+
+func manifestPath() string {
+	return baseDir() + "/manifest"
+}
+
+func manifestSignaturePath() string {
+	return manifestPath() + ".sig"
+}
+
+// Generates the store's signing key and returns the public key in hex.
+func keygen() (publicKeyHex string, err error) {
+	if _, err = os.Stat(getPrivateKeyPath()); err == nil {
+		err = errors.New("Key already exists, refusing to overwrite it.")
+		return
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(keysDir(), 0700); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(getPrivateKeyPath(), []byte(hex.EncodeToString(privateKey)+"\n"), 0600); err != nil {
+		return
+	}
+	publicKeyHex = hex.EncodeToString(publicKey)
+	err = ioutil.WriteFile(getPublicKeyPath(), []byte(publicKeyHex+"\n"), 0644)
+	return
+}
+
+func loadPrivateKey() (privateKey ed25519.PrivateKey, err error) {
+	privateKeyByte, err := ioutil.ReadFile(getPrivateKeyPath())
+	if os.IsNotExist(err) {
+		err = errors.New("No signing key, run decensor keygen first.")
+		return
+	}
+	if err != nil {
+		return
+	}
+	privateKey, err = hex.DecodeString(strings.TrimSpace(string(privateKeyByte)))
+	if err == nil && len(privateKey) != ed25519.PrivateKeySize {
+		err = errors.New("Private key is the wrong length.")
+	}
+	return
+}
+
+// Takes a public key in hex, or a file containing one.
+func parsePublicKey(input string) (publicKey ed25519.PublicKey, err error) {
+	if !isHex(input) || len(input) != ed25519.PublicKeySize*2 {
+		publicKeyByte, readErr := ioutil.ReadFile(input)
+		if readErr != nil {
+			err = errors.New("Public keys must be 64 hex characters or a file containing them.")
+			return
+		}
+		input = strings.TrimSpace(string(publicKeyByte))
+	}
+	publicKey, err = hex.DecodeString(input)
+	if err == nil && len(publicKey) != ed25519.PublicKeySize {
+		err = errors.New("Public key is the wrong length.")
+	}
+	return
+}
+
+func buildManifest(publicKey ed25519.PublicKey) (manifest []byte, err error) {
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	contents := signedManifest{Created: time.Now().UTC().Format(time.RFC3339),
+		PublicKey: hex.EncodeToString(publicKey),
+		Assets:    []manifestAsset{}}
+	for _, asset := range all_assets {
+		size, err := getAssetSize(asset)
+		if err != nil {
+			return nil, err
+		}
+		asset_tags := tags_by_asset(asset)
+		if asset_tags == nil {
+			asset_tags = []string{}
+		}
+		contents.Assets = append(contents.Assets, manifestAsset{Asset: asset,
+			Filename: getAssetFilename(asset),
+			Size:     size,
+			Tags:     asset_tags})
+	}
+	manifest, err = json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return
+	}
+	manifest = append(manifest, '\n')
+	return
+}
+
+// Writes a freshly signed manifest of the whole store.
+func sign() (err error) {
+	if storeEncrypted() {
+		return errors.New("Encrypted stores can't sign a manifest, it would publish filenames and tags in the clear.")
+	}
+	privateKey, err := loadPrivateKey()
+	if err != nil {
+		return
+	}
+	manifest, err := buildManifest(privateKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		return
+	}
+	signature := hex.EncodeToString(ed25519.Sign(privateKey, manifest)) + "\n"
+	// Write both before replacing either, so a mirror being served from this
+	// store only briefly has a manifest that doesn't match its signature.
+	if err = ioutil.WriteFile(manifestPath()+".tmp", manifest, 0644); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(manifestSignaturePath()+".tmp", []byte(signature), 0644); err != nil {
+		return
+	}
+	if err = os.Rename(manifestPath()+".tmp", manifestPath()); err != nil {
+		return
+	}
+	if err = os.Rename(manifestSignaturePath()+".tmp", manifestSignaturePath()); err != nil {
+		return
+	}
+	// replicate only fetches manifests from peers whose journal moved on.
+	return journal(journalEntry{Op: "sign", Name: "public_key", Value: hex.EncodeToString(privateKey.Public().(ed25519.PublicKey))})
+}
+
+func checkManifestSignature(manifest []byte, signature []byte, publicKey ed25519.PublicKey) (contents signedManifest, err error) {
+	signatureBytes, err := hex.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || len(signatureBytes) != ed25519.SignatureSize {
+		err = errors.New("Manifest signature is not a hex ed25519 signature.")
+		return
+	}
+	if !ed25519.Verify(publicKey, manifest, signatureBytes) {
+		err = errors.New("Manifest signature does not match the public key.")
+		return
+	}
+	err = json.Unmarshal(manifest, &contents)
+	return
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// How long a peer gets to answer before we give up on it, so one that
+// accepts a connection and says nothing can't hang sync or replicate.
+var httpTimeout = time.Minute
+
+var httpTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: httpTimeout,
+	IdleConnTimeout:       90 * time.Second,
+}
+
+// For manifests, changes, chunks and the like, the whole request has to
+// finish within httpTimeout.
+var httpClient = &http.Client{Transport: httpTransport, Timeout: httpTimeout}
+
+// For whole assets, which take as long as they take once the peer answers,
+// as long as it doesn't stop sending for httpTimeout.
+var httpStreamClient = &http.Client{Transport: httpTransport}
+
+// Returned when a peer stops sending partway through a body.
+type idleTimeoutError struct {
+	url string
+}
+
+func (err idleTimeoutError) Error() string {
+	return fmt.Sprintf("%s sent nothing for %s", err.url, httpTimeout)
+}
+
+func (err idleTimeoutError) Timeout() bool {
+	return true
+}
+
+func (err idleTimeoutError) Temporary() bool {
+	return true
+}
+
+// Cancels the request if no bytes arrive for httpTimeout.
+type idleTimeoutBody struct {
+	body     io.ReadCloser
+	url      string
+	timer    *time.Timer
+	timedOut int32
+	cancel   context.CancelFunc
+}
+
+func (body *idleTimeoutBody) Read(p []byte) (n int, err error) {
+	n, err = body.body.Read(p)
+	if err != nil && atomic.LoadInt32(&body.timedOut) == 1 {
+		return n, idleTimeoutError{body.url}
+	}
+	body.timer.Reset(httpTimeout)
+	return
+}
+
+func (body *idleTimeoutBody) Close() error {
+	body.timer.Stop()
+	body.cancel()
+	return body.body.Close()
+}
+
+// Whether err is a peer taking too long, rather than refusing or failing.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func httpGet(url string) (body io.ReadCloser, err error) {
+	return httpGetWith(context.Background(), httpClient, url)
+}
+
+func httpGetAsset(url string) (body io.ReadCloser, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	response, err := httpGetWith(ctx, httpStreamClient, url)
+	if err != nil {
+		cancel()
+		return
+	}
+	idle := &idleTimeoutBody{body: response, url: url, cancel: cancel}
+	idle.timer = time.AfterFunc(httpTimeout, func() {
+		atomic.StoreInt32(&idle.timedOut, 1)
+		cancel()
+	})
+	body = idle
+	return
+}
+
+func httpGetWith(ctx context.Context, client *http.Client, url string) (body io.ReadCloser, err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		err = fmt.Errorf("%s returned %s", url, response.Status)
+		return
+	}
+	body = response.Body
+	return
+}
+
+func readSource(source string) ([]byte, error) {
+	if !isURL(source) {
+		return ioutil.ReadFile(source)
+	}
+	body, err := httpGet(source)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// Hashes an asset from a mirror, or from the local store, and checks it
+// matches its name and the size in the manifest.
+func verifyManifestAsset(item manifestAsset, root string) (err error) {
+	algorithm, _, err := assetAlgorithmAndDigest(item.Asset)
+	if err != nil {
+		return
+	}
+	var reader io.ReadCloser
+	if root != "" {
+		reader, err = httpGetAsset(root + "asset/" + item.Asset)
+	} else {
+		reader, err = openAsset(item.Asset)
+	}
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	counter := &countingWriter{}
+	hash, err := hashReader(io.TeeReader(reader, counter), algorithm)
+	if err != nil {
+		return
+	}
+	if hash != item.Asset {
+		return fmt.Errorf("%s does not match %s", hash, item.Asset)
+	}
+	if counter.count != item.Size {
+		return fmt.Errorf("%s is %d bytes, manifest says %d", item.Asset, counter.count, item.Size)
+	}
+	return
+}
+
+type countingWriter struct {
+	count int64
+}
+
+func (counter *countingWriter) Write(p []byte) (int, error) {
+	counter.count += int64(len(p))
+	return len(p), nil
+}
+
+// Checks a manifest's signature and then every asset in it. source is either
+// a mirror's manifest URL, whose assets we download, or a manifest file,
+// whose assets we check in the local store.
+func verifyManifest(source string, publicKeyInput string) (verified int, err error) {
+	publicKey, err := parsePublicKey(publicKeyInput)
+	if err != nil {
+		return
+	}
+	root := ""
+	if isURL(source) {
+		source, root = mirrorManifestURL(source)
+	}
+	manifest, err := readSource(source)
+	if err != nil {
+		return
+	}
+	signature, err := readSource(source + ".sig")
+	if err != nil {
+		return
+	}
+	contents, err := checkManifestSignature(manifest, signature, publicKey)
+	if err != nil {
+		return
+	}
+	failed := 0
+	for _, item := range contents.Assets {
+		if assetErr := verifyManifestAsset(item, root); assetErr != nil {
+			log.Printf("%s (%s): %s", item.Asset, item.Filename, assetErr.Error())
+			failed++
+			continue
+		}
+		verified++
+	}
+	if failed != 0 {
+		err = fmt.Errorf("%d of %d assets failed verification.", failed, len(contents.Assets))
+	}
+	return
+}
+
+func httpManifest(w http.ResponseWriter, r *http.Request, path string, mimeType string) {
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		http.Error(w, "No signed manifest, run decensor sign.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	defer fd.Close()
+	stat, err := fd.Stat()
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Cache-Control", revalidateCacheControl)
+	http.ServeContent(w, r, "", stat.ModTime(), fd)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckManifestSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := []byte(`{"created":"2019-07-15T00:00:00Z","assets":[{"asset":"d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26","filename":"hello","size":12,"tags":["foo"]}]}`)
+	signature := []byte(hex.EncodeToString(ed25519.Sign(privateKey, manifest)) + "\n")
+	contents, err := checkManifestSignature(manifest, signature, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents.Assets) != 1 || contents.Assets[0].Filename != "hello" {
+		t.Errorf("Manifest parsed wrong: %+v", contents)
+	}
+	manifest[len(manifest)-3] = 'x'
+	if _, err = checkManifestSignature(manifest, signature, publicKey); err == nil {
+		t.Error("A modified manifest should not verify")
+	}
+	if _, err = checkManifestSignature(manifest, []byte("nothex"), publicKey); err == nil {
+		t.Error("A garbage signature should not verify")
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	if _, err := parsePublicKey("d669f98fff841751662d35e036929fce82a995731632b7cbce2c038b38c3409c"); err != nil {
+		t.Error(err)
+	}
+	for _, input := range []string{"d669f98f", "/nonexistent/public_key"} {
+		if _, err := parsePublicKey(input); err == nil {
+			t.Errorf("Should not parse %s", input)
+		}
+	}
+}
+
+func TestHttpGetTimesOut(t *testing.T) {
+	stop := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stop
+	}))
+	defer server.Close()
+	defer close(stop)
+	defaultClient := httpClient
+	httpClient = &http.Client{Transport: httpTransport, Timeout: 50 * time.Millisecond}
+	defer func() { httpClient = defaultClient }()
+	if _, err := httpGet(server.URL); err == nil {
+		t.Errorf("Expected a peer that never answers to time out")
+	}
+}
+
+func TestHttpGetAssetTimesOutWhenThePeerStalls(t *testing.T) {
+	stop := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		<-stop
+	}))
+	defer server.Close()
+	defer close(stop)
+	defaultTimeout := httpTimeout
+	httpTimeout = 50 * time.Millisecond
+	defer func() { httpTimeout = defaultTimeout }()
+	body, err := httpGetAsset(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	contents, err := ioutil.ReadAll(body)
+	if !isTimeout(err) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if string(contents) != "partial" {
+		t.Errorf("Expected what was sent before the stall, got %q", contents)
+	}
+}
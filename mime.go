@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"mime"
 	"net/http"
@@ -11,11 +14,109 @@ import (
 	"strings"
 )
 
+// Signatures for formats http.DetectContentType does not know about.
+var magicSignatures = []struct {
+	offset   int
+	magic    string
+	mimeType string
+}{
+	{0, "%PDF-", "application/pdf"},
+	{0, "fLaC", "audio/flac"},
+	{0, "\x1a\x45\xdf\xa3", "video/x-matroska"},
+	{30, "mimetypeapplication/epub+zip", "application/epub+zip"},
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "\xfd7zXZ\x00", "application/x-xz"},
+	{0, "BZh", "application/x-bzip2"},
+	{4, "ftypheic", "image/heic"},
+	{4, "ftypqt  ", "video/quicktime"},
+	{0, "OggS", "application/ogg"},
+}
+
+// How many bytes we read from an asset to sniff its mime type.
+const sniffBytes = 512
+
+func sniffMimeType(head []byte) string {
+	for _, signature := range magicSignatures {
+		end := signature.offset + len(signature.magic)
+		if len(head) >= end && string(head[signature.offset:end]) == signature.magic {
+			// WebM is Matroska too, but http.DetectContentType knows it.
+			if signature.mimeType == "video/x-matroska" && bytes.Contains(head, []byte("webm")) {
+				return "video/webm"
+			}
+			return signature.mimeType
+		}
+	}
+	return http.DetectContentType(head)
+}
+
+func getAssetFilePathSniffedMimeType(asset string) string {
+	return metadataDir() + "/" + asset + "/sniffed_mime"
+}
+
+// Returns the mime type from the asset's magic bytes. This is cached in
+// metadata so we don't have to read every asset for /mimes/.
+func getAssetSniffedMimeType(asset string) (mimeType string) {
+	mimeTypeByte, err := ioutil.ReadFile(getAssetFilePathSniffedMimeType(asset))
+	if err == nil {
+		mimeType = strings.Trim(string(mimeTypeByte), "\n")
+		return
+	}
+	head, _, err := readAssetHead(asset, sniffBytes)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	mimeType = sniffMimeType(head)
+	// Caching is best effort, we may be read only in web mode.
+	if err = init_metadata(asset); err == nil {
+		err = ioutil.WriteFile(getAssetFilePathSniffedMimeType(asset), []byte(mimeType+"\n"), 0644)
+	}
+	if err != nil {
+		log.Printf("Unable to cache mime type for %s: %s", asset, err.Error())
+	}
+	return
+}
+
+func getAssetFilePathMimeOverride(asset string) string {
+	return metadataDir() + "/" + asset + "/mime"
+}
+
+// Overrides whatever mime type we would detect for an asset.
+func setAssetMimeType(asset string, mimeType string) error {
+	var err error
+	if err = validateAsset(asset); err != nil {
+		return err
+	}
+	if !assetExists(asset) {
+		return errors.New("Asset does not exist, cannot set mime type.")
+	}
+	if _, _, err = mime.ParseMediaType(mimeType); err != nil || !strings.Contains(mimeType, "/") {
+		return errors.New("Mime type must look like major/minor, e.g. video/mp2t.")
+	}
+	if err = init_metadata(asset); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(getAssetFilePathMimeOverride(asset), []byte(mimeType+"\n"), 0644); err != nil {
+		return err
+	}
+	return journalMetadata(asset, "mime", mimeType)
+}
+
+func getAssetMimeTypeOverride(asset string) string {
+	mimeTypeByte, err := ioutil.ReadFile(getAssetFilePathMimeOverride(asset))
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(string(mimeTypeByte), "\n")
+}
+
 func getAssetMimeType(asset string) (mimeType string) {
+	// An operator set override always wins.
+	if mimeType = getAssetMimeTypeOverride(asset); mimeType != "" {
+		return
+	}
 	// Try to get the mime type from the filename if we have a filename.
 	// Not all files, like CSS, can get the mime type from magic bytes.
-	// This does not return a mime type from magic bytes if we don't have
-	// a filename or can't detect it from the extension alone.
 	filename := getAssetFilename(asset)
 	extension := filepath.Ext(filename)
 	if extension == ".md" {
@@ -24,7 +125,19 @@ func getAssetMimeType(asset string) (mimeType string) {
 		// the future.
 		mimeType = "text/plain"
 	} else {
-		mimeType = mime.TypeByExtension(filepath.Ext(filename))
+		mimeType = mime.TypeByExtension(extension)
+	}
+	// Fall back to magic bytes if we have no extension, or if the extension
+	// claims text but the content is clearly a known binary format.
+	if mimeType == "" || isTextualMimeType(mimeType) {
+		sniffedMimeType := getAssetSniffedMimeType(asset)
+		if mimeType == "" {
+			if sniffedMimeType != "application/octet-stream" {
+				mimeType = sniffedMimeType
+			}
+		} else if sniffedMimeType != "application/octet-stream" && !isTextualMimeType(sniffedMimeType) {
+			mimeType = sniffedMimeType
+		}
 	}
 	return
 }
@@ -51,6 +164,23 @@ func getAssetsByMimeTypeMajor(mimeType string) (assetsOutput []string, err error
 	return
 }
 
+func getAssetsByMimeType(mimeType string) (assetsOutput []string, err error) {
+	// Takes either a major type (video) or a full type (video/mp4).
+	if !strings.Contains(mimeType, "/") {
+		return getAssetsByMimeTypeMajor(mimeType)
+	}
+	assets, err := assets()
+	if err != nil {
+		return
+	}
+	for _, asset := range assets {
+		if baseMimeType(getAssetMimeType(asset)) == mimeType {
+			assetsOutput = append(assetsOutput, asset)
+		}
+	}
+	return
+}
+
 func getMimeTypes() (mimeTypes map[string]uint64, err error) {
 	mimeTypes = make(map[string]uint64)
 	// Returns major mime types.
@@ -68,10 +198,46 @@ func getMimeTypes() (mimeTypes map[string]uint64, err error) {
 	return
 }
 
+func getFullMimeTypes() (mimeTypes map[string]uint64, err error) {
+	mimeTypes = make(map[string]uint64)
+	// Returns full mime types without parameters (video/mp4, text/plain)
+	assets, err := assets()
+	if err != nil {
+		return
+	}
+	for _, asset := range assets {
+		assetMimeType := baseMimeType(getAssetMimeType(asset))
+		if assetMimeType != "" {
+			mimeTypes[assetMimeType] += 1
+		}
+	}
+	return
+}
+
+func sortedMimeTypes(mimeTypes map[string]uint64) (keys []string) {
+	// If we don't sort this, output is very unstable in terms of order.
+	for key := range mimeTypes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func validateMimeTypePath(mimeType string) error {
+	if mimeType == "" || strings.Contains(mimeType, "..") || strings.Count(mimeType, "/") > 1 {
+		return errors.New("Mime types must be major or major/minor.")
+	}
+	return nil
+}
+
 func httpMimeType(w http.ResponseWriter, r *http.Request) {
-	pathParts := strings.Split(r.URL.Path, "/")
-	mimeType := pathParts[len(pathParts)-1]
-	mimeAssets, err := getAssetsByMimeTypeMajor(mimeType)
+	// /mime/video or /mime/video/mp4
+	mimeType := strings.Trim(strings.TrimPrefix(r.URL.Path, "/mime/"), "/")
+	if err := validateMimeTypePath(mimeType); err != nil {
+		httpHandle400(w, err)
+		return
+	}
+	mimeAssets, err := getAssetsByMimeType(mimeType)
 	if err != nil {
 		httpHandle500(w, err)
 		return
@@ -81,7 +247,7 @@ func httpMimeType(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "No such assets under that mime type found.", http.StatusNotFound)
 		return
 	}
-	formatted_assets, err := assetListHTML(mimeAssets, "")
+	formatted_assets, err := assetListHTMLOffset(mimeAssets, "", 1+strings.Count(mimeType, "/"))
 	if err != nil {
 		httpHandle500(w, err)
 		return
@@ -94,26 +260,49 @@ func httpMimeType(w http.ResponseWriter, r *http.Request) {
 }
 
 func httpMimeTypes(w http.ResponseWriter, r *http.Request) {
-	output, err := headHTML(1)
-	if err != nil {
-		httpHandle500(w, err)
+	// /mimes/ lists major types, /mimes/video drills down to video/mp4, etc.
+	major := strings.Trim(strings.TrimPrefix(r.URL.Path, "/mimes/"), "/")
+	if strings.Contains(major, "/") {
+		httpHandle400(w, errors.New("Drill down only works on major mime types."))
 		return
 	}
-	allMimes, err := getMimeTypes()
+	output, err := headHTML(1)
 	if err != nil {
 		httpHandle500(w, err)
 		return
 	}
-	// If we don't sort this, output is very unstable in terms of order.
-	var keys []string
-	for key := range allMimes {
-		keys = append(keys, key)
-	}
-	sort.Strings(keys)
-	for _, key := range keys {
-		output += fmt.Sprintf("<div><a class=\"btn btn-outline-secondary\" href=\"../mime/%s\">%s/* <span class=\"badge badge-dark\">%d</span></a></div>\n", key, key, allMimes[key])
+	if major == "" {
+		allMimes, err := getMimeTypes()
+		if err != nil {
+			httpHandle500(w, err)
+			return
+		}
+		for _, key := range sortedMimeTypes(allMimes) {
+			output += fmt.Sprintf("<div><a class=\"btn btn-outline-secondary\" href=\"../mimes/%s\">%s/* <span class=\"badge badge-dark\">%d</span></a></div>\n", key, key, allMimes[key])
+		}
+	} else {
+		allMimes, err := getFullMimeTypes()
+		if err != nil {
+			httpHandle500(w, err)
+			return
+		}
+		var majorCount uint64
+		var formatted_mimes string
+		for _, key := range sortedMimeTypes(allMimes) {
+			if getMimeMajor(key) != major {
+				continue
+			}
+			majorCount += allMimes[key]
+			formatted_mimes += fmt.Sprintf("<div><a class=\"btn btn-outline-secondary\" href=\"../mime/%s\">%s <span class=\"badge badge-dark\">%d</span></a></div>\n", key, key, allMimes[key])
+		}
+		if majorCount == 0 {
+			http.Error(w, "No such assets under that mime type found.", http.StatusNotFound)
+			return
+		}
+		output += fmt.Sprintf("<div><a class=\"btn btn-outline-primary\" href=\"../mime/%s\">All %s/* <span class=\"badge badge-dark\">%d</span></a></div>\n", major, major, majorCount)
+		output += formatted_mimes
 	}
-	output += footerHTML
+	output += footerHTML()
 	_, err = io.WriteString(w, output)
 	if err != nil {
 		log.Print(err)
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSniffMimeType(t *testing.T) {
+	epub := "PK\x03\x04" + string(make([]byte, 26)) + "mimetypeapplication/epub+zip"
+	cases := map[string]string{
+		"%PDF-1.4\n":                   "application/pdf",
+		"fLaC\x00\x00\x00\x22":         "audio/flac",
+		"\x1a\x45\xdf\xa3\x42matroska": "video/x-matroska",
+		"\x1a\x45\xdf\xa3\x42webm":     "video/webm",
+		epub:                           "application/epub+zip",
+		"\x89PNG\x0d\x0a\x1a\x0a":      "image/png",
+		"Hello World\n":                "text/plain; charset=utf-8",
+	}
+	for head, expected := range cases {
+		if mimeType := sniffMimeType([]byte(head)); mimeType != expected {
+			t.Errorf("Expected %s, got %s for %q", expected, mimeType, head)
+		}
+	}
+}
+
+func TestValidateMimeTypePath(t *testing.T) {
+	for _, mimeType := range []string{"video", "video/mp4", "application/epub+zip"} {
+		if validateMimeTypePath(mimeType) != nil {
+			t.Errorf("%s should be a valid mime type path.", mimeType)
+		}
+	}
+	for _, mimeType := range []string{"", "video/mp4/extra", "../etc", "video/.."} {
+		if validateMimeTypePath(mimeType) == nil {
+			t.Errorf("%s should not be a valid mime type path.", mimeType)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Assets are named by a multihash (https://multiformats.io/multihash/) of
+// their content, written in hex. SHA-256 assets keep the legacy 64 hex
+// character name (the same digest without the 1220 multihash prefix) so
+// existing stores and links keep working.
+
+type hashAlgorithm struct {
+	name string
+	code uint64
+	size int
+	new  func() hash.Hash
+}
+
+var hashAlgorithms = []hashAlgorithm{
+	{"sha2-256", 0x12, sha256.Size, sha256.New},
+	{"sha2-512", 0x13, sha512.Size, sha512.New},
+	{"blake2b-256", 0xb220, 32, func() hash.Hash { return newBLAKE2b(32) }},
+}
+
+// Recorded as metadata so assets can be matched against published checksum
+// lists. sha256 is only stored for assets that aren't named by it already.
+var secondaryHashes = []hashAlgorithm{
+	{"md5", 0xd5, md5.Size, md5.New},
+	{"sha1", 0x11, sha1.Size, sha1.New},
+	{"sha256", 0x12, sha256.Size, sha256.New},
+}
+
+const defaultHashAlgorithm = "sha2-256"
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func getHashAlgorithm(name string) (algorithm hashAlgorithm, err error) {
+	for _, algorithm = range hashAlgorithms {
+		if algorithm.name == name {
+			return
+		}
+	}
+	err = errors.New("Unknown hash algorithm: " + name)
+	return
+}
+
+// The algorithm new assets are added with, from the hash_algorithm setting.
+func storeHashAlgorithm() (hashAlgorithm, error) {
+	name := getSetting("hash_algorithm")
+	if name == "" {
+		name = defaultHashAlgorithm
+	}
+	return getHashAlgorithm(name)
+}
+
+func isLegacyAsset(asset string) bool {
+	return len(asset) == 64 && isHex(asset)
+}
+
+func parseMultihash(multihash []byte) (algorithm hashAlgorithm, digest []byte, err error) {
+	code, codeLength := binary.Uvarint(multihash)
+	if codeLength <= 0 {
+		err = errors.New("Invalid multihash.")
+		return
+	}
+	size, sizeLength := binary.Uvarint(multihash[codeLength:])
+	if sizeLength <= 0 {
+		err = errors.New("Invalid multihash.")
+		return
+	}
+	digest = multihash[codeLength+sizeLength:]
+	for _, algorithm = range hashAlgorithms {
+		if algorithm.code == code {
+			if uint64(algorithm.size) != size || len(digest) != algorithm.size {
+				err = errors.New("Multihash digest is the wrong length.")
+			}
+			return
+		}
+	}
+	err = errors.New("Unsupported multihash algorithm.")
+	return
+}
+
+func encodeMultihash(algorithm hashAlgorithm, digest []byte) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	multihash := append([]byte{}, varint[:binary.PutUvarint(varint[:], algorithm.code)]...)
+	multihash = append(multihash, varint[:binary.PutUvarint(varint[:], uint64(len(digest)))]...)
+	return append(multihash, digest...)
+}
+
+// The name an asset with this digest is stored under.
+func assetFromDigest(algorithm hashAlgorithm, digest []byte) string {
+	if algorithm.name == "sha2-256" {
+		return hex.EncodeToString(digest)
+	}
+	return hex.EncodeToString(encodeMultihash(algorithm, digest))
+}
+
+func assetAlgorithmAndDigest(asset string) (algorithm hashAlgorithm, digest []byte, err error) {
+	if isLegacyAsset(asset) {
+		algorithm, _ = getHashAlgorithm("sha2-256")
+		digest, err = hex.DecodeString(asset)
+		return
+	}
+	if !isHex(asset) {
+		err = errors.New("Assets must be hex.")
+		return
+	}
+	multihash, err := hex.DecodeString(asset)
+	if err != nil {
+		return
+	}
+	return parseMultihash(multihash)
+}
+
+func assetMultihash(asset string) ([]byte, error) {
+	algorithm, digest, err := assetAlgorithmAndDigest(asset)
+	if err != nil {
+		return nil, err
+	}
+	return encodeMultihash(algorithm, digest), nil
+}
+
+func base58Encode(data []byte) string {
+	number := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	modulo := new(big.Int)
+	var encoded []byte
+	for number.Sign() > 0 {
+		number.DivMod(number, radix, modulo)
+		encoded = append(encoded, base58Alphabet[modulo.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
+
+func base58Decode(encoded string) ([]byte, error) {
+	number := new(big.Int)
+	radix := big.NewInt(58)
+	for _, character := range encoded {
+		value := strings.IndexRune(base58Alphabet, character)
+		if value == -1 {
+			return nil, errors.New("Invalid base58.")
+		}
+		number.Mul(number, radix)
+		number.Add(number, big.NewInt(int64(value)))
+	}
+	decoded := number.Bytes()
+	for _, character := range encoded {
+		if character != rune(base58Alphabet[0]) {
+			break
+		}
+		decoded = append([]byte{0}, decoded...)
+	}
+	return decoded, nil
+}
+
+// Base58 multihash, the short form (Qm... for SHA-256).
+func assetMultihashString(asset string) string {
+	multihash, err := assetMultihash(asset)
+	if err != nil {
+		return ""
+	}
+	return base58Encode(multihash)
+}
+
+// Takes an asset in any form we accept (legacy hex, hex multihash or base58
+// multihash) and returns the name it's stored under.
+func resolveAsset(input string) (asset string, err error) {
+	input = strings.TrimSpace(input)
+	if isLegacyAsset(input) {
+		return input, nil
+	}
+	var multihash []byte
+	if isHex(input) && len(input)%2 == 0 {
+		multihash, err = hex.DecodeString(input)
+	} else {
+		multihash, err = base58Decode(input)
+	}
+	if err != nil {
+		err = errors.New("Assets must be hex SHA256 or a hex or base58 multihash.")
+		return
+	}
+	algorithm, digest, err := parseMultihash(multihash)
+	if err != nil {
+		return
+	}
+	asset = assetFromDigest(algorithm, digest)
+	return
+}
+
+// Hashes a file with an algorithm, returning the asset name it would have.
+func hashFile(path string, algorithm hashAlgorithm) (asset string, err error) {
+	// If we do this all in one chunk, we can easily run out of memory on big files.
+	// Instead, we use io.Copy and hash as we go.
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	return hashReader(fd, algorithm)
+}
+
+func hashReader(reader io.Reader, algorithm hashAlgorithm) (asset string, err error) {
+	digest := algorithm.new()
+	if _, err = io.Copy(digest, reader); err != nil {
+		return
+	}
+	asset = assetFromDigest(algorithm, digest.Sum(nil))
+	return
+}
+
+func getAssetFilePathChecksum(asset string, name string) string {
+	return metadataDir() + "/" + asset + "/" + name
+}
+
+func computeChecksums(asset string) (checksums map[string]string, err error) {
+	hashers := make(map[string]hash.Hash)
+	var writers []io.Writer
+	for _, algorithm := range secondaryHashes {
+		if algorithm.name == "sha256" && isLegacyAsset(asset) {
+			continue
+		}
+		hashers[algorithm.name] = algorithm.new()
+		writers = append(writers, hashers[algorithm.name])
+	}
+	fd, err := openAsset(asset)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	if _, err = io.Copy(io.MultiWriter(writers...), fd); err != nil {
+		return
+	}
+	checksums = make(map[string]string)
+	for name, hasher := range hashers {
+		checksums[name] = hex.EncodeToString(hasher.Sum(nil))
+	}
+	return
+}
+
+func writeChecksums(asset string, checksums map[string]string) (err error) {
+	if err = init_metadata(asset); err != nil {
+		return
+	}
+	for name, checksum := range checksums {
+		if err = ioutil.WriteFile(getAssetFilePathChecksum(asset, name), []byte(checksum+"\n"), 0644); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Computes and stores the secondary hashes for an asset.
+func addChecksums(asset string) error {
+	checksums, err := computeChecksums(asset)
+	if err != nil {
+		return err
+	}
+	return writeChecksums(asset, checksums)
+}
+
+var (
+	// Assets web mode is priming in the background. Requests don't hash
+	// these themselves, they'd only be doing the same work over again.
+	primingAssets     = make(map[string]bool)
+	primingAssetsLock sync.Mutex
+	// Returned instead when an asset hasn't been hashed yet.
+	errNotHashed = errors.New("Asset has not been hashed yet.")
+)
+
+func hashOnDemand(asset string) bool {
+	primingAssetsLock.Lock()
+	defer primingAssetsLock.Unlock()
+	return !primingAssets[asset]
+}
+
+var (
+	// Web mode can't write checksums it works out once it drops
+	// privileges, so it keeps them here.
+	checksumCache     = make(map[string]map[string]string)
+	checksumCacheLock sync.Mutex
+)
+
+// Returns a secondary hash (md5, sha1, sha256) of an asset in hex.
+func getAssetChecksum(asset string, name string) (checksum string, err error) {
+	if name == "sha256" && isLegacyAsset(asset) {
+		return asset, nil
+	}
+	checksumCacheLock.Lock()
+	checksum, ok := checksumCache[asset][name]
+	checksumCacheLock.Unlock()
+	if ok {
+		return
+	}
+	checksumByte, err := ioutil.ReadFile(getAssetFilePathChecksum(asset, name))
+	if err == nil {
+		checksum = strings.Trim(string(checksumByte), "\n")
+		return
+	}
+	if !os.IsNotExist(err) {
+		return
+	}
+	if !hashOnDemand(asset) {
+		return "", errNotHashed
+	}
+	// Assets from before we recorded these.
+	checksums, err := hashChecksums(asset)
+	if err != nil {
+		return
+	}
+	checksum, ok = checksums[name]
+	if !ok {
+		err = errors.New("Unknown checksum: " + name)
+	}
+	return
+}
+
+// Computes and records the checksums, in memory if we're read only in web mode.
+func hashChecksums(asset string) (checksums map[string]string, err error) {
+	if checksums, err = computeChecksums(asset); err != nil {
+		return
+	}
+	if cacheErr := writeChecksums(asset, checksums); cacheErr != nil {
+		if !inChroot {
+			log.Printf("Unable to cache checksums for %s: %s", asset, cacheErr.Error())
+		}
+		checksumCacheLock.Lock()
+		checksumCache[asset] = checksums
+		checksumCacheLock.Unlock()
+	}
+	return
+}
+
+// Works out every asset's checksums, CID and torrent hashes that aren't
+// recorded yet in the background, so web mode doesn't hash a whole asset in
+// a request. Assets are marked before this returns so requests leave them be.
+func startPrimingAssetHashes() (err error) {
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	primingAssetsLock.Lock()
+	for _, asset := range all_assets {
+		primingAssets[asset] = true
+	}
+	primingAssetsLock.Unlock()
+	go primeAssetHashes(all_assets)
+	return
+}
+
+// One bad asset doesn't stop the rest. Once an asset is done, or failed,
+// requests can hash it themselves.
+func primeAssetHashes(all_assets []string) {
+	for _, asset := range all_assets {
+		if err := primeHashes(asset); err != nil {
+			log.Printf("Unable to prime hashes for %s: %s", asset, err.Error())
+		}
+		primingAssetsLock.Lock()
+		delete(primingAssets, asset)
+		primingAssetsLock.Unlock()
+	}
+}
+
+func primeHashes(asset string) (err error) {
+	for _, algorithm := range secondaryHashes {
+		if _, err = getAssetChecksum(asset, algorithm.name); err == errNotHashed {
+			_, err = hashChecksums(asset)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if _, err = getAssetCID(asset); err == errNotHashed {
+		_, err = hashCID(asset)
+	}
+	if err != nil {
+		return
+	}
+	size, err := getAssetSize(asset)
+	if err != nil {
+		return
+	}
+	pieceLength := torrentPieceLength(size)
+	if _, err = getAssetTorrentHashes(asset, pieceLength); err == errNotHashed {
+		_, err = hashTorrentHashes(asset, pieceLength)
+	}
+	return
+}
+
+// Finds assets by any checksum or identifier we know about.
+func lookup(checksum string) (matches []string, err error) {
+	if asset, resolveErr := resolveAsset(checksum); resolveErr == nil {
+		if assetExists(asset) {
+			return []string{asset}, nil
+		}
+	}
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	for _, asset := range all_assets {
+		for _, algorithm := range secondaryHashes {
+			if len(checksum) != algorithm.size*2 {
+				continue
+			}
+			assetChecksum, err := getAssetChecksum(asset, algorithm.name)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			if assetChecksum == checksum {
+				matches = append(matches, asset)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestResolveAsset(t *testing.T) {
+	legacy := "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26"
+	for _, input := range []string{legacy, "1220" + legacy, "QmcWyBPyedDzHFytTX6CAjjpvqQAyhzURziwiBKDKgqx6R"} {
+		asset, err := resolveAsset(input)
+		if err != nil {
+			t.Errorf("%s: %s", input, err.Error())
+		}
+		if asset != legacy {
+			t.Errorf("Expected %s for %s, got %s", legacy, input, asset)
+		}
+	}
+	if assetMultihashString(legacy) != "QmcWyBPyedDzHFytTX6CAjjpvqQAyhzURziwiBKDKgqx6R" {
+		t.Errorf("Wrong base58 multihash: %s", assetMultihashString(legacy))
+	}
+	// Wrong length, unknown algorithm and not hex or base58.
+	for _, input := range []string{"1220" + legacy[:62], "9920" + legacy, "zz0l", ""} {
+		if _, err := resolveAsset(input); err == nil {
+			t.Errorf("Should not resolve %s", input)
+		}
+	}
+}
+
+func TestValidateMultihashAsset(t *testing.T) {
+	algorithm, err := getHashAlgorithm("blake2b-256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := assetFromDigest(algorithm, make([]byte, 32))
+	if asset[:8] != "a0e40220" {
+		t.Errorf("Expected a blake2b-256 multihash, got %s", asset)
+	}
+	if !validate_asset(asset) {
+		t.Errorf("%s should be a valid asset", asset)
+	}
+	if validate_asset(asset + "00") {
+		t.Errorf("%s00 should not be a valid asset", asset)
+	}
+}
+
+func TestBase58(t *testing.T) {
+	for _, data := range [][]byte{{}, {0}, {0, 0, 1}, {255, 254}} {
+		decoded, err := base58Decode(base58Encode(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("Expected %v, got %v", data, decoded)
+		}
+	}
+}
+
+func TestPrimeAssetHashes(t *testing.T) {
+	t.Setenv("DECENSOR_DIR", t.TempDir()+"/store")
+	if err := init_folders(); err != nil {
+		t.Fatal(err)
+	}
+	source := t.TempDir() + "/source"
+	if err := ioutil.WriteFile(source, []byte("prime me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	asset, err := add(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like an asset from before checksums and CIDs were recorded.
+	for _, path := range []string{getAssetFilePathChecksum(asset, "md5"), getAssetFilePathCID(asset)} {
+		if err = os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	primingAssets[asset] = true
+	if _, err = getAssetChecksum(asset, "md5"); err != errNotHashed {
+		t.Errorf("Expected errNotHashed for md5, got %v", err)
+	}
+	if _, err = getAssetCID(asset); err != errNotHashed {
+		t.Errorf("Expected errNotHashed for the CID, got %v", err)
+	}
+	// A missing asset first shouldn't stop the rest being primed.
+	missing := "0000000000000000000000000000000000000000000000000000000000000000"
+	primingAssets[missing] = true
+	primeAssetHashes([]string{missing, asset})
+	if len(primingAssets) != 0 {
+		t.Errorf("Every asset should be done priming, got %v", primingAssets)
+	}
+	if checksum, err := getAssetChecksum(asset, "md5"); err != nil || checksum == "" {
+		t.Errorf("Expected md5 after priming, got %q %v", checksum, err)
+	}
+	if cid, err := getAssetCID(asset); err != nil || cid == "" {
+		t.Errorf("Expected a CID after priming, got %q %v", cid, err)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Peers are mirrors we replicate from continuously. Each one is a directory
+// under peersDir() holding its URL and the state of the last replication run,
+// one file per value like metadata, so the web UI can show it without
+// having to be the process doing the replicating.
+
+const defaultReplicateInterval = 5 * time.Minute
+
+type peerStatus struct {
+	URL         string
+	LastAttempt time.Time
+	LastSuccess time.Time
+	// Assets the peer has that we don't, as of the last attempt.
+	Behind int
+	Error  string
+	// The peer's journal sequence number when we last synced everything.
+	Seq int64
+}
+
+func peersDir() string {
+	return baseDir() + "/peers"
+}
+
+func getPeerPath(url string) string {
+	id := sha256.Sum256([]byte(url))
+	return peersDir() + "/" + hex.EncodeToString(id[:8])
+}
+
+func normalizePeerURL(url string) (string, error) {
+	if !isURL(url) {
+		return "", errors.New("Peers must be http or https URLs.")
+	}
+	if strings.HasSuffix(url, "/manifest") {
+		url = strings.TrimSuffix(url, "manifest")
+	}
+	return strings.TrimSuffix(url, "/") + "/", nil
+}
+
+func addPeer(url string) (err error) {
+	if url, err = normalizePeerURL(url); err != nil {
+		return
+	}
+	directory := getPeerPath(url)
+	if _, err = os.Stat(directory); err == nil {
+		return errors.New("Peer already exists.")
+	}
+	if err = os.MkdirAll(directory, 0755); err != nil {
+		return
+	}
+	return ioutil.WriteFile(directory+"/url", []byte(url+"\n"), 0644)
+}
+
+func removePeer(url string) (err error) {
+	if url, err = normalizePeerURL(url); err != nil {
+		return
+	}
+	directory := getPeerPath(url)
+	if _, err = os.Stat(directory); os.IsNotExist(err) {
+		return errors.New("No such peer.")
+	}
+	return os.RemoveAll(directory)
+}
+
+func getPeerValue(directory string, name string) string {
+	valueByte, err := ioutil.ReadFile(directory + "/" + name)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(string(valueByte), "\n")
+}
+
+func peers() (statuses []peerStatus, err error) {
+	directories, err := list_directory(peersDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	for _, directory := range directories {
+		directory = peersDir() + "/" + directory
+		status := peerStatus{URL: getPeerValue(directory, "url"),
+			Error: getPeerValue(directory, "error")}
+		if status.URL == "" {
+			continue
+		}
+		status.LastAttempt, _ = time.Parse(time.RFC3339, getPeerValue(directory, "last_attempt"))
+		status.LastSuccess, _ = time.Parse(time.RFC3339, getPeerValue(directory, "last_success"))
+		if status.Behind, err = strconv.Atoi(getPeerValue(directory, "behind")); err != nil {
+			// Never replicated.
+			status.Behind = -1
+			err = nil
+		}
+		status.Seq, _ = strconv.ParseInt(getPeerValue(directory, "seq"), 10, 64)
+		statuses = append(statuses, status)
+	}
+	return
+}
+
+func writePeerStatus(status peerStatus) (err error) {
+	directory := getPeerPath(status.URL)
+	values := map[string]string{"last_attempt": status.LastAttempt.UTC().Format(time.RFC3339),
+		"behind": strconv.Itoa(status.Behind),
+		"error":  status.Error,
+		"seq":    strconv.FormatInt(status.Seq, 10)}
+	if !status.LastSuccess.IsZero() {
+		values["last_success"] = status.LastSuccess.UTC().Format(time.RFC3339)
+	}
+	for name, value := range values {
+		if err = ioutil.WriteFile(directory+"/"+name, []byte(value+"\n"), 0644); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// One pass over a peer. Assets are verified against their hash as they
+// are downloaded and tags are merged, see syncFromMirror().
+func replicatePeer(status peerStatus) peerStatus {
+	status.LastAttempt = time.Now()
+	// Peers with a journal tell us cheaply if anything changed. Asked before
+	// syncing, so changes made while we sync are picked up next time.
+	latest, seqErr := fetchLatestSeq(status.URL, status.Seq)
+	if seqErr == nil && latest == status.Seq && status.Seq != 0 && status.Error == "" && status.Behind == 0 {
+		status.LastSuccess = status.LastAttempt
+		return status
+	}
+	result, err := syncFromMirror(status.URL, false)
+	status.Behind = result.Failed
+	if err != nil {
+		status.Error = err.Error()
+		if result.Assets == 0 {
+			// We didn't even get the manifest, so we don't know how far behind we are.
+			status.Behind = -1
+		}
+	} else {
+		status.Error = ""
+		status.LastSuccess = status.LastAttempt
+		if seqErr == nil {
+			status.Seq = latest
+		}
+	}
+	return status
+}
+
+// Replicates from every peer, forever. Run alongside `decensor web`, which
+// drops privileges and can't write to the store itself.
+func replicate(interval time.Duration) {
+	for {
+		statuses, err := peers()
+		if err != nil {
+			log.Print(err)
+		}
+		for _, status := range statuses {
+			status = replicatePeer(status)
+			if status.Error != "" {
+				log.Printf("Replicating from %s: %s", status.URL, status.Error)
+			}
+			if err = writePeerStatus(status); err != nil {
+				log.Print(err)
+			}
+		}
+		refreshReplicationReport()
+		time.Sleep(interval)
+	}
+}
+
+func parseReplicateInterval(seconds string) (interval time.Duration, err error) {
+	parsed, err := strconv.Atoi(seconds)
+	if err != nil || parsed <= 0 {
+		err = errors.New("Interval must be a positive number of seconds.")
+		return
+	}
+	interval = time.Duration(parsed) * time.Second
+	return
+}
+
+func formatPeerTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339) + " (" + time.Since(t).Round(time.Second).String() + " ago)"
+}
+
+func peersListing(statuses []peerStatus) (output []string) {
+	for _, status := range statuses {
+		behind := strconv.Itoa(status.Behind)
+		if status.Behind < 0 {
+			behind = "unknown"
+		}
+		line := fmt.Sprintf("%s last_success=%s behind=%s", status.URL, formatPeerTime(status.LastSuccess), behind)
+		if status.Error != "" {
+			line += " error=" + status.Error
+		}
+		output = append(output, line)
+	}
+	return
+}
+
+const peersHTMLTemplate = `
+{{if not .}}<p>No peers. Add one with <code>decensor peers add &lt;url&gt;</code> and run <code>decensor replicate</code>.</p>{{end}}
+{{range .}}
+<div class="card card-body mb-2"><h5><a href="{{.URL}}">{{.URL}}</a></h5>
+<div class="small">Last attempt: {{formatPeerTime .LastAttempt}}</div>
+<div class="small">Last success: {{formatPeerTime .LastSuccess}}</div>
+<div class="small">Assets behind: {{if lt .Behind 0}}unknown{{else}}{{.Behind}}{{end}}</div>
+{{if .Error}}<div class="alert alert-danger small">{{.Error}}</div>{{end}}
+</div>
+{{end}}
+`
+
+var peersHTMLTmpl = template.Must(template.New("peers").Funcs(template.FuncMap{"formatPeerTime": formatPeerTime}).Parse(peersHTMLTemplate))
+
+func httpPeers(w http.ResponseWriter, r *http.Request) {
+	statuses, err := peers()
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	output, err := headHTML(0)
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	var rendered strings.Builder
+	if err = peersHTMLTmpl.Execute(&rendered, statuses); err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	output += rendered.String() + footerHTML()
+	// Times are relative, so don't let this be cached.
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err = io.WriteString(w, output); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizePeerURL(t *testing.T) {
+	for _, url := range []string{"https://example.com", "https://example.com/", "https://example.com/manifest"} {
+		normalized, err := normalizePeerURL(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if normalized != "https://example.com/" {
+			t.Errorf("Expected https://example.com/ for %s, got %s", url, normalized)
+		}
+	}
+	if _, err := normalizePeerURL("example.com"); err == nil {
+		t.Error("Peers without a scheme should not be accepted")
+	}
+}
+
+func TestParseReplicateInterval(t *testing.T) {
+	interval, err := parseReplicateInterval("60")
+	if err != nil || interval != time.Minute {
+		t.Errorf("Expected a minute, got %s %v", interval, err)
+	}
+	for _, seconds := range []string{"0", "-5", "soon"} {
+		if _, err = parseReplicateInterval(seconds); err == nil {
+			t.Errorf("%s should not be a valid interval", seconds)
+		}
+	}
+}
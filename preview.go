@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// How much of a textual asset we read for the permalink preview.
+const previewBytes = 64 * 1024
+
+// Non text/* mime types that are still safe and useful to show as text.
+var textualMimeTypes = []string{
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/x-yaml",
+	"application/x-shellscript",
+	"application/x-sh",
+	"application/toml",
+	"application/sql",
+	"image/svg+xml",
+}
+
+// Strips parameters like "; charset=utf-8" from a mime type.
+func baseMimeType(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	}
+	return mediaType
+}
+
+func isTextualMimeType(mimeType string) bool {
+	mimeType = baseMimeType(mimeType)
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	if strings.HasSuffix(mimeType, "+json") || strings.HasSuffix(mimeType, "+xml") {
+		return true
+	}
+	for _, textualMimeType := range textualMimeTypes {
+		if mimeType == textualMimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads up to limit bytes of an asset. truncated is true if there was more.
+func readAssetHead(asset string, limit int64) (head []byte, truncated bool, err error) {
+	fd, err := openAsset(asset)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	// Read one extra byte so we know if we are truncating.
+	head, err = ioutil.ReadAll(io.LimitReader(fd, limit+1))
+	if err != nil {
+		return
+	}
+	if int64(len(head)) > limit {
+		head = head[:limit]
+		truncated = true
+	}
+	return
+}
+
+func looksBinary(content []byte, truncated bool) bool {
+	if bytes.IndexByte(content, 0) != -1 {
+		return true
+	}
+	if truncated {
+		// We may have cut a multibyte character in half.
+		for i := 0; i < utf8.UTFMax && len(content) > 0; i++ {
+			if utf8.Valid(content) {
+				break
+			}
+			content = content[:len(content)-1]
+		}
+	}
+	return !utf8.Valid(content)
+}
+
+func lineNumberedHTML(content string) string {
+	var output strings.Builder
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	width := len(fmt.Sprint(len(lines)))
+	output.WriteString("<pre class=\"border p-2 small\"><code>")
+	for index, line := range lines {
+		fmt.Fprintf(&output, "<span class=\"text-muted\">%*d</span>  %s\n", width, index+1, html.EscapeString(line))
+	}
+	output.WriteString("</code></pre>\n")
+	return output.String()
+}
+
+func csvTableHTML(content []byte, truncated bool) (output string, err error) {
+	if truncated {
+		// Drop the last, probably partial, row.
+		if lastNewline := bytes.LastIndexByte(content, '\n'); lastNewline != -1 {
+			content = content[:lastNewline+1]
+		}
+	}
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return
+	}
+	var table strings.Builder
+	table.WriteString("<div class=\"table-responsive\"><table class=\"table table-sm table-bordered small\">\n")
+	for index, record := range records {
+		cell := "td"
+		if index == 0 {
+			cell = "th"
+		}
+		table.WriteString("<tr>")
+		for _, field := range record {
+			fmt.Fprintf(&table, "<%s>%s</%s>", cell, html.EscapeString(field), cell)
+		}
+		table.WriteString("</tr>\n")
+	}
+	table.WriteString("</table></div>\n")
+	output = table.String()
+	return
+}
+
+func previewNoticeHTML(notice string) string {
+	return fmt.Sprintf("<div class=\"alert alert-secondary small\">%s</div>\n", notice)
+}
+
+// Returns an HTML preview of the start of a textual asset.
+func textPreviewHTML(asset string, mimeType string) (output string, err error) {
+	content, truncated, err := readAssetHead(asset, previewBytes)
+	if err != nil {
+		return
+	}
+	if looksBinary(content, truncated) {
+		output = previewNoticeHTML("This file appears to be binary, no preview available.")
+		return
+	}
+	switch baseMimeType(mimeType) {
+	case "text/csv":
+		var table string
+		if table, err = csvTableHTML(content, truncated); err == nil {
+			output = table
+		} else {
+			// Not really CSV, fall back to plain text.
+			err = nil
+			output = lineNumberedHTML(string(content))
+		}
+	case "application/json":
+		var indented bytes.Buffer
+		if !truncated && json.Indent(&indented, content, "", "  ") == nil {
+			output = lineNumberedHTML(indented.String())
+		} else {
+			output = lineNumberedHTML(string(content))
+		}
+	default:
+		output = lineNumberedHTML(string(content))
+	}
+	if truncated {
+		output += previewNoticeHTML(fmt.Sprintf("Preview truncated to the first %d KB.", previewBytes/1024))
+	}
+	return
+}
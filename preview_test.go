@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsTextualMimeType(t *testing.T) {
+	for _, mimeType := range []string{"text/plain; charset=utf-8", "text/csv", "application/json", "image/svg+xml", "application/ld+json"} {
+		if !isTextualMimeType(mimeType) {
+			t.Errorf("%s is textual but we think it is not.", mimeType)
+		}
+	}
+	for _, mimeType := range []string{"", "image/png", "video/mp4", "application/octet-stream"} {
+		if isTextualMimeType(mimeType) {
+			t.Errorf("%s is not textual but we think it is.", mimeType)
+		}
+	}
+}
+
+func TestLooksBinary(t *testing.T) {
+	if looksBinary([]byte("Hello World\n"), false) {
+		t.Error("Plain text should not look binary.")
+	}
+	if !looksBinary([]byte("Hello\x00World"), false) {
+		t.Error("NUL bytes should look binary.")
+	}
+	// "é" is two bytes, cut in half by truncation.
+	if looksBinary([]byte("caf\xc3"), true) {
+		t.Error("A truncated multibyte character should not look binary.")
+	}
+	if !looksBinary([]byte("caf\xc3"), false) {
+		t.Error("Invalid UTF-8 should look binary when not truncated.")
+	}
+}
+
+func TestCSVTableHTML(t *testing.T) {
+	table, err := csvTableHTML([]byte("name,size\n<b>,1\npartial,"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(table, "<th>name</th>") {
+		t.Error("First CSV row should be a header.")
+	}
+	if !strings.Contains(table, "<td>&lt;b&gt;</td>") {
+		t.Error("CSV fields should be escaped.")
+	}
+	if strings.Contains(table, "partial") {
+		t.Error("Truncated CSV should drop the partial last row.")
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// push sends assets to another instance. The remote says which assets it
+// lacks and how much of each it already has from an interrupted push, then
+// each one is uploaded from there into incomingDir(). Only once the whole
+// file is there and matches its hash is it moved into the store, with its
+// filename and tags.
+//
+// Pushes are authenticated with the remote's push token, from
+// `decensor push_token` on the remote and DECENSOR_PUSH_TOKEN here. Partial
+// pushes nobody has resumed for incomingExpiry are deleted.
+
+// How many times to resume an asset before giving up on it.
+const pushAttempts = 3
+
+const pushTokenEnvironment = "DECENSOR_PUSH_TOKEN"
+
+const incomingExpiry = 24 * time.Hour
+
+type pushMissingRequest struct {
+	Assets []string `json:"assets"`
+}
+
+type pushMissingAsset struct {
+	Asset string `json:"asset"`
+	// Bytes already received, to resume from.
+	Offset int64 `json:"offset"`
+}
+
+type pushMissingResponse struct {
+	Missing []pushMissingAsset `json:"missing"`
+}
+
+func incomingDir() string {
+	return baseDir() + "/incoming"
+}
+
+func getIncomingPath(asset string) string {
+	return incomingDir() + "/" + asset
+}
+
+func getPushTokenPath() string {
+	return keysDir() + "/push_token"
+}
+
+// Creates a new push token, replacing any old one.
+func pushToken() (token string, err error) {
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	token = hex.EncodeToString(random)
+	if err = os.MkdirAll(keysDir(), 0700); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(getPushTokenPath(), []byte(token+"\n"), 0600)
+	return
+}
+
+func checkPushToken(r *http.Request) error {
+	tokenByte, err := ioutil.ReadFile(getPushTokenPath())
+	if err != nil {
+		return errors.New("Pushing is not enabled here.")
+	}
+	if !validPushToken(strings.TrimSpace(string(tokenByte)), r.Header.Get("Authorization")) {
+		return errors.New("Invalid push token.")
+	}
+	return nil
+}
+
+func validPushToken(token string, authorization string) bool {
+	if token == "" || !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(given)) == 1
+}
+
+var errPartialBusy = errors.New("Another request is already sending this, try again once it's done.")
+
+// Opens a partial push or upload to append to, flag is os.O_CREATE or 0.
+// It's locked so only one request at a time can check where it's up to and
+// add to it. Closing it unlocks.
+func openPartial(path string, flag int) (fd *os.File, err error) {
+	fd, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|flag, 0644)
+	if err != nil {
+		return
+	}
+	if err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		fd.Close()
+		if err == syscall.EWOULDBLOCK {
+			err = errPartialBusy
+		}
+		return nil, err
+	}
+	return
+}
+
+func partialOffset(fd *os.File) int64 {
+	stat, err := fd.Stat()
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+func incomingOffset(asset string) int64 {
+	stat, err := os.Stat(getIncomingPath(asset))
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+// Deletes partial pushes nobody has added to for incomingExpiry.
+func expireIncoming() (err error) {
+	partials, err := list_directory(incomingDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	for _, asset := range partials {
+		stat, statErr := os.Stat(getIncomingPath(asset))
+		if statErr == nil && time.Since(stat.ModTime()) < incomingExpiry {
+			continue
+		}
+		// Something is still writing to it.
+		fd, lockErr := openPartial(getIncomingPath(asset), 0)
+		if lockErr == errPartialBusy {
+			continue
+		}
+		log.Printf("Expiring partial push of %s.", asset)
+		err = os.Remove(getIncomingPath(asset))
+		if fd != nil {
+			fd.Close()
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+func pushMissing(candidates []string) (missing []pushMissingAsset, err error) {
+	missing = []pushMissingAsset{}
+	for _, asset := range candidates {
+		if err = validateAsset(asset); err != nil {
+			return
+		}
+		if assetExists(asset) {
+			continue
+		}
+		missing = append(missing, pushMissingAsset{Asset: asset, Offset: incomingOffset(asset)})
+	}
+	return
+}
+
+// Moves a fully received asset into the store if it matches its hash.
+func commitIncoming(asset string, filename string, asset_tags []string) (err error) {
+	path := getIncomingPath(asset)
+	algorithm, _, err := assetAlgorithmAndDigest(asset)
+	if err != nil {
+		return
+	}
+	hash, err := hashFile(path, algorithm)
+	if err != nil {
+		return
+	}
+	if hash != asset {
+		os.Remove(path)
+		return fmt.Errorf("%s does not match %s", hash, asset)
+	}
+	if assetExists(asset) {
+		// Someone else got it here first.
+		os.Remove(path)
+	} else {
+		if err = storeAssetFile(asset, path); err != nil {
+			return
+		}
+		if err = addAssetMetadata(asset, filepath.Base(filename)); err != nil {
+			return
+		}
+	}
+	return tagMissing(asset, asset_tags)
+}
+
+func httpPushMissing(w http.ResponseWriter, r *http.Request) {
+	if err := checkPushToken(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a list of assets.", http.StatusMethodNotAllowed)
+		return
+	}
+	var request pushMissingRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024*1024)).Decode(&request); err != nil {
+		httpHandle400(w, err)
+		return
+	}
+	missing, err := pushMissing(request.Assets)
+	if err != nil {
+		httpHandle400(w, err)
+		return
+	}
+	output, err := json.Marshal(pushMissingResponse{Missing: missing})
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(append(output, '\n')); err != nil {
+		log.Print(err)
+	}
+}
+
+// PUT /push/asset/<asset>?offset=<bytes so far>&size=<total bytes>&filename=<filename>&tag=<tag>...
+// The body is the asset from offset on. 202 if we still need more, 201 once it's stored.
+func httpPushAsset(w http.ResponseWriter, r *http.Request) {
+	if err := checkPushToken(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPut {
+		http.Error(w, "PUT the asset.", http.StatusMethodNotAllowed)
+		return
+	}
+	asset := strings.TrimPrefix(r.URL.Path, "/push/asset/")
+	query := r.URL.Query()
+	if err := validateAsset(asset); err != nil {
+		httpHandle400(w, err)
+		return
+	}
+	offset, offsetErr := strconv.ParseInt(query.Get("offset"), 10, 64)
+	size, sizeErr := strconv.ParseInt(query.Get("size"), 10, 64)
+	if offsetErr != nil || sizeErr != nil || offset < 0 || offset > size {
+		httpHandle400(w, errors.New("offset and size must be byte counts."))
+		return
+	}
+	for _, tag := range query["tag"] {
+		if err := validateTagName(tag); err != nil {
+			httpHandle400(w, err)
+			return
+		}
+	}
+	if assetExists(asset) {
+		// Already have it, only the tags are news.
+		if err := tagMissing(asset, query["tag"]); err != nil {
+			httpHandle500(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	// Stores from before push existed won't have the directory.
+	if err := os.MkdirAll(incomingDir(), 0755); err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	fd, err := openPartial(getIncomingPath(asset), os.O_CREATE)
+	if err == errPartialBusy {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	defer fd.Close()
+	if current := partialOffset(fd); current != offset {
+		// The client has the wrong idea of where we are, it can ask again.
+		http.Error(w, fmt.Sprintf("Have %d bytes, not %d.", current, offset), http.StatusConflict)
+		return
+	}
+	// Whatever arrives before the client goes away is kept for next time.
+	received, err := io.Copy(fd, io.LimitReader(r.Body, size-offset+1))
+	if err != nil {
+		log.Printf("Push of %s interrupted after %d bytes: %s", asset, offset+received, err.Error())
+		return
+	}
+	if offset+received > size {
+		os.Remove(getIncomingPath(asset))
+		httpHandle400(w, errors.New("Received more than size."))
+		return
+	}
+	if offset+received < size {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err = commitIncoming(asset, query.Get("filename"), query["tag"]); err != nil {
+		httpHandle400(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Everything that writes to the store, all behind the push token.
+func registerReceiveHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/push/missing", httpPushMissing)
+	mux.HandleFunc("/push/asset/", httpPushAsset)
+	mux.HandleFunc("/upload", httpUpload)
+	mux.HandleFunc("/upload/", httpUpload)
+	go expireUploadsLoop()
+}
+
+// Accepts pushes and uploads, for stores whose `decensor web` runs as root and so
+// can't write to the store. Runs as whoever owns the store.
+func receive(port string) {
+	if isUser(Root) {
+		log.Print("Receiving pushes as root, consider running as the store's owner instead.")
+	}
+	if _, err := os.Stat(getPushTokenPath()); os.IsNotExist(err) {
+		log.Fatal("No push token, run decensor push_token first.")
+	}
+	// Ask for the passphrase now rather than when the first push arrives.
+	if storeEncrypted() {
+		if _, err := getStoreKeys(); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	mux := http.NewServeMux()
+	registerReceiveHandlers(mux)
+	log.Fatal(http.ListenAndServe(port, mux))
+}
+
+func pushRequest(method string, requestURL string, token string, body io.Reader, contentLength int64) (response *http.Response, err error) {
+	request, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return
+	}
+	request.ContentLength = contentLength
+	request.Header.Set("Authorization", "Bearer "+token)
+	// Pushes stream whole assets, so only the wait for an answer is limited.
+	return httpStreamClient.Do(request)
+}
+
+func fetchPushMissing(root string, token string, candidates []string) (missing []pushMissingAsset, err error) {
+	requestBody, err := json.Marshal(pushMissingRequest{Assets: candidates})
+	if err != nil {
+		return
+	}
+	response, err := pushRequest(http.MethodPost, root+"push/missing", token, bytes.NewReader(requestBody), int64(len(requestBody)))
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		err = fmt.Errorf("%s returned %s: %s", root, response.Status, strings.TrimSpace(string(message)))
+		return
+	}
+	var parsed pushMissingResponse
+	if err = json.NewDecoder(io.LimitReader(response.Body, 64*1024*1024)).Decode(&parsed); err != nil {
+		return
+	}
+	missing = parsed.Missing
+	return
+}
+
+// Uploads one asset from offset, with its filename and tags.
+func pushAssetFrom(root string, token string, asset string, offset int64) (err error) {
+	size, err := getAssetSize(asset)
+	if err != nil {
+		return
+	}
+	fd, err := openAsset(asset)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	if _, err = fd.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	query := url.Values{"offset": {strconv.FormatInt(offset, 10)},
+		"size":     {strconv.FormatInt(size, 10)},
+		"filename": {getAssetFilename(asset)},
+		"tag":      tags_by_asset(asset)}
+	response, err := pushRequest(http.MethodPut, root+"push/asset/"+asset+"?"+query.Encode(), token, fd, size-offset)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		err = fmt.Errorf("%s returned %s: %s", root, response.Status, strings.TrimSpace(string(message)))
+	}
+	return
+}
+
+// Pushes an asset, asking the remote where to resume from if it fails part way.
+func pushAsset(root string, token string, missing pushMissingAsset) (err error) {
+	for attempt := 1; attempt <= pushAttempts; attempt++ {
+		if attempt != 1 {
+			var remaining []pushMissingAsset
+			if remaining, err = fetchPushMissing(root, token, []string{missing.Asset}); err != nil {
+				continue
+			}
+			if len(remaining) == 0 {
+				return nil
+			}
+			missing = remaining[0]
+		}
+		if err = pushAssetFrom(root, token, missing.Asset, missing.Offset); err == nil {
+			return
+		}
+		log.Printf("Pushing %s, attempt %d: %s", missing.Asset, attempt, err.Error())
+	}
+	return
+}
+
+// Assets to push: everything, or the union of some tags.
+func pushCandidates(push_tags []string) (candidates []string, err error) {
+	if len(push_tags) == 0 {
+		return assets()
+	}
+	seen := make(map[string]bool)
+	for _, tag := range push_tags {
+		tag_assets, err := assets_by_tag(tag)
+		if err != nil {
+			return nil, err
+		}
+		for _, asset := range tag_assets {
+			if !seen[asset] {
+				seen[asset] = true
+				candidates = append(candidates, asset)
+			}
+		}
+	}
+	return
+}
+
+type pushResult struct {
+	// Assets we offered.
+	Assets int
+	// Assets the remote lacked.
+	Missing int
+	Pushed  int
+	Failed  int
+}
+
+func push(remote string, push_tags []string) (result pushResult, err error) {
+	if !isURL(remote) {
+		err = errors.New("Remotes must be http or https URLs.")
+		return
+	}
+	root := strings.TrimSuffix(remote, "/") + "/"
+	token := os.Getenv(pushTokenEnvironment)
+	if token == "" {
+		err = errors.New("Set " + pushTokenEnvironment + " to the remote's push token.")
+		return
+	}
+	candidates, err := pushCandidates(push_tags)
+	if err != nil {
+		return
+	}
+	result.Assets = len(candidates)
+	if len(candidates) == 0 {
+		return
+	}
+	missing, err := fetchPushMissing(root, token, candidates)
+	if err != nil {
+		return
+	}
+	result.Missing = len(missing)
+	for _, item := range missing {
+		if item.Offset != 0 {
+			log.Printf("Resuming %s from %d bytes.", item.Asset, item.Offset)
+		}
+		if err = pushAsset(root, token, item); err != nil {
+			log.Printf("%s (%s): %s", item.Asset, getAssetFilename(item.Asset), err.Error())
+			result.Failed++
+			continue
+		}
+		result.Pushed++
+	}
+	err = nil
+	if result.Failed != 0 {
+		err = fmt.Errorf("%d of %d assets failed to push.", result.Failed, result.Missing)
+	}
+	return
+}
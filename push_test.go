@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestValidPushToken(t *testing.T) {
+	token := "0123456789abcdef"
+	if !validPushToken(token, "Bearer "+token) {
+		t.Errorf("Token should be valid")
+	}
+	for _, authorization := range []string{"", token, "Bearer ", "Bearer 0123456789abcde", "Bearer " + token + "0", "Basic " + token} {
+		if validPushToken(token, authorization) {
+			t.Errorf("%s should not be valid", authorization)
+		}
+	}
+	if validPushToken("", "Bearer ") {
+		t.Errorf("An empty token should never be valid")
+	}
+}
+
+func TestOpenPartialIsExclusive(t *testing.T) {
+	path := t.TempDir() + "/partial"
+	fd, err := openPartial(path, os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = openPartial(path, 0); err != errPartialBusy {
+		t.Errorf("Expected errPartialBusy while it's open, got %v", err)
+	}
+	fd.Close()
+	fd, err = openPartial(path, 0)
+	if err != nil {
+		t.Errorf("Should be able to open it once it's closed: %v", err)
+	} else {
+		fd.Close()
+	}
+}
+
+func TestExpireIncoming(t *testing.T) {
+	t.Setenv("DECENSOR_DIR", t.TempDir()+"/store")
+	if err := init_folders(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(incomingDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	recent := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	abandoned := "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+	for _, asset := range []string{recent, abandoned} {
+		if err := ioutil.WriteFile(getIncomingPath(asset), []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-incomingExpiry - time.Hour)
+	if err := os.Chtimes(getIncomingPath(abandoned), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := expireIncoming(); err != nil {
+		t.Fatal(err)
+	}
+	if incomingOffset(recent) != 7 {
+		t.Errorf("A recent partial push should be kept")
+	}
+	if _, err := os.Stat(getIncomingPath(abandoned)); !os.IsNotExist(err) {
+		t.Errorf("An abandoned partial push should expire: %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many copies of each asset are out there, counting ours and every peer
+// that both lists the asset in its signed manifest and actually serves it.
+// Peers are slow to ask, so the report is saved in the store and the web UI
+// shows the last one. `decensor replicate` refreshes it every
+// replicationReportInterval. Once an asset has enough copies nobody else is
+// asked about it.
+
+const defaultMinimumCopies = 2
+
+const replicationReportInterval = time.Hour
+
+// How many assets we ask a peer about at once.
+const replicationWorkers = 8
+
+type assetReplication struct {
+	Asset    string   `json:"asset"`
+	Filename string   `json:"filename"`
+	Copies   int      `json:"copies"`
+	Peers    []string `json:"peers"`
+}
+
+type tagReplication struct {
+	Tag    string `json:"tag"`
+	AtRisk int    `json:"at_risk"`
+	Total  int    `json:"total"`
+}
+
+type replicationReport struct {
+	Generated     time.Time `json:"generated"`
+	MinimumCopies int       `json:"minimum_copies"`
+	TotalAssets   int       `json:"total_assets"`
+	Peers         []string  `json:"peers"`
+	// Peers we couldn't ask, and why.
+	Unreachable map[string]string `json:"unreachable"`
+	// Only assets with fewer than MinimumCopies copies.
+	AtRisk []assetReplication `json:"at_risk"`
+	Tags   []tagReplication   `json:"tags"`
+}
+
+func replicationReportPath() string {
+	return baseDir() + "/replication_report.json"
+}
+
+// Checks that a peer serves an asset at the size we expect. Peers with a
+// manifest are only asked about assets the manifest lists.
+func peerServesAsset(root string, asset string, size int64) bool {
+	response, err := httpClient.Head(root + "asset/" + asset)
+	if err != nil {
+		return false
+	}
+	response.Body.Close()
+	return response.StatusCode == http.StatusOK && response.ContentLength == size
+}
+
+// Returns which of the assets in sizes a peer has.
+func peerCopies(root string, sizes map[string]int64) (held map[string]bool, err error) {
+	held = make(map[string]bool)
+	candidates := sizes
+	manifestURL, _ := mirrorManifestURL(root)
+	if contents, _, manifestErr := fetchMirrorManifest(manifestURL); manifestErr == nil {
+		candidates = make(map[string]int64)
+		for _, item := range contents.Assets {
+			if size, ok := sizes[item.Asset]; ok && size == item.Size {
+				candidates[item.Asset] = size
+			}
+		}
+	} else {
+		// Not worth asking about every asset if the peer is down.
+		var body io.ReadCloser
+		if body, err = httpGet(root); err != nil {
+			return
+		}
+		body.Close()
+	}
+	var mutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	jobs := make(chan string)
+	for worker := 0; worker < replicationWorkers; worker++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for asset := range jobs {
+				if peerServesAsset(root, asset, candidates[asset]) {
+					mutex.Lock()
+					held[asset] = true
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for asset := range candidates {
+		jobs <- asset
+	}
+	close(jobs)
+	waitGroup.Wait()
+	return
+}
+
+func buildReplicationReport(minimumCopies int) (report replicationReport, err error) {
+	report = replicationReport{Generated: time.Now().UTC(),
+		MinimumCopies: minimumCopies,
+		Peers:         []string{},
+		Unreachable:   make(map[string]string),
+		AtRisk:        []assetReplication{},
+		Tags:          []tagReplication{}}
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	report.TotalAssets = len(all_assets)
+	sizes := make(map[string]int64)
+	holders := make(map[string][]string)
+	for _, asset := range all_assets {
+		if sizes[asset], err = getAssetSize(asset); err != nil {
+			return
+		}
+	}
+	statuses, err := peers()
+	if err != nil {
+		return
+	}
+	for _, status := range statuses {
+		// Our own copy counts, so minimumCopies-1 peers is enough.
+		wanted := make(map[string]int64)
+		for asset, size := range sizes {
+			if 1+len(holders[asset]) < minimumCopies {
+				wanted[asset] = size
+			}
+		}
+		held, peerErr := peerCopies(status.URL, wanted)
+		if peerErr != nil {
+			report.Unreachable[status.URL] = peerErr.Error()
+			continue
+		}
+		report.Peers = append(report.Peers, status.URL)
+		for asset := range held {
+			holders[asset] = append(holders[asset], status.URL)
+		}
+	}
+	atRisk := make(map[string]bool)
+	for _, asset := range all_assets {
+		// Our own copy counts.
+		copies := 1 + len(holders[asset])
+		if copies >= minimumCopies {
+			continue
+		}
+		atRisk[asset] = true
+		peers := holders[asset]
+		if peers == nil {
+			peers = []string{}
+		}
+		sort.Strings(peers)
+		report.AtRisk = append(report.AtRisk, assetReplication{Asset: asset,
+			Filename: getAssetFilename(asset),
+			Copies:   copies,
+			Peers:    peers})
+	}
+	all_tags, err := tags()
+	if err != nil {
+		return
+	}
+	for _, tag := range all_tags {
+		tag_assets, err := assets_by_tag(tag)
+		if err != nil {
+			return report, err
+		}
+		tagReport := tagReplication{Tag: tag, Total: len(tag_assets)}
+		for _, asset := range tag_assets {
+			if atRisk[asset] {
+				tagReport.AtRisk++
+			}
+		}
+		if tagReport.AtRisk != 0 {
+			report.Tags = append(report.Tags, tagReport)
+		}
+	}
+	// Worst tags first.
+	sort.SliceStable(report.Tags, func(i, j int) bool {
+		return report.Tags[i].AtRisk > report.Tags[j].AtRisk
+	})
+	return
+}
+
+func saveReplicationReport(report replicationReport) (err error) {
+	if storeEncrypted() {
+		if report, err = encryptReplicationReport(report); err != nil {
+			return
+		}
+	}
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(replicationReportPath()+".tmp", append(output, '\n'), 0644); err != nil {
+		return
+	}
+	return os.Rename(replicationReportPath()+".tmp", replicationReportPath())
+}
+
+func loadReplicationReport() (report replicationReport, err error) {
+	reportByte, err := ioutil.ReadFile(replicationReportPath())
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(reportByte, &report); err != nil {
+		return
+	}
+	// Filenames and tags are saved encrypted in encrypted stores.
+	for index, item := range report.AtRisk {
+		if report.AtRisk[index].Filename, err = decryptFilename(item.Asset, item.Filename); err != nil {
+			return
+		}
+	}
+	for index, item := range report.Tags {
+		if report.Tags[index].Tag, err = decodeTag(item.Tag); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func parseMinimumCopies(copies string) (minimumCopies int, err error) {
+	minimumCopies, err = strconv.Atoi(copies)
+	if err != nil || minimumCopies < 1 {
+		err = errors.New("Minimum copies must be a positive number.")
+	}
+	return
+}
+
+func formatReplicationReport(report replicationReport) (output []string) {
+	output = append(output, fmt.Sprintf("%d of %d assets have fewer than %d copies, checked %d peers.", len(report.AtRisk), report.TotalAssets, report.MinimumCopies, len(report.Peers)))
+	var unreachable []string
+	for peer := range report.Unreachable {
+		unreachable = append(unreachable, peer)
+	}
+	sort.Strings(unreachable)
+	for _, peer := range unreachable {
+		output = append(output, "Unreachable peer: "+peer+" "+report.Unreachable[peer])
+	}
+	for _, tag := range report.Tags {
+		output = append(output, fmt.Sprintf("At risk tag: %s %d of %d", tag.Tag, tag.AtRisk, tag.Total))
+	}
+	for _, item := range report.AtRisk {
+		line := fmt.Sprintf("%s %d %s", item.Asset, item.Copies, item.Filename)
+		if len(item.Peers) != 0 {
+			line += " (" + strings.Join(item.Peers, ", ") + ")"
+		}
+		output = append(output, line)
+	}
+	return
+}
+
+func replicationReportCommand(minimumCopies int) (output []string, err error) {
+	report, err := buildReplicationReport(minimumCopies)
+	if err != nil {
+		return
+	}
+	if err = saveReplicationReport(report); err != nil {
+		return
+	}
+	output = formatReplicationReport(report)
+	return
+}
+
+// Returns a copy with the filenames and tags encrypted.
+func encryptReplicationReport(report replicationReport) (encrypted replicationReport, err error) {
+	encrypted = report
+	encrypted.AtRisk = make([]assetReplication, len(report.AtRisk))
+	for index, item := range report.AtRisk {
+		if item.Filename, err = encryptFilename(item.Asset, item.Filename); err != nil {
+			return
+		}
+		encrypted.AtRisk[index] = item
+	}
+	encrypted.Tags = make([]tagReplication, len(report.Tags))
+	for index, item := range report.Tags {
+		if item.Tag, err = encodeTag(item.Tag); err != nil {
+			return
+		}
+		encrypted.Tags[index] = item
+	}
+	return
+}
+
+// Keeps the saved report fresh, with whatever minimum the operator last asked
+// for. Does nothing if it's younger than replicationReportInterval.
+func refreshReplicationReport() {
+	minimumCopies := defaultMinimumCopies
+	if previous, err := loadReplicationReport(); err == nil {
+		if time.Since(previous.Generated) < replicationReportInterval {
+			return
+		}
+		if previous.MinimumCopies > 0 {
+			minimumCopies = previous.MinimumCopies
+		}
+	}
+	report, err := buildReplicationReport(minimumCopies)
+	if err == nil {
+		err = saveReplicationReport(report)
+	}
+	if err != nil {
+		log.Printf("Unable to refresh the replication report: %s", err.Error())
+	}
+}
+
+const replicationHTMLTemplate = `
+{{if .Generated.IsZero}}<p>No replication report yet. Run <code>decensor replication_report</code>, or <code>decensor replicate</code> with some peers.</p>{{else}}
+<p>{{len .AtRisk}} of {{.TotalAssets}} assets have fewer than {{.MinimumCopies}} copies across this mirror and {{len .Peers}} reachable peers, as of {{.Generated.Format "2006-01-02T15:04:05Z07:00"}}.</p>
+{{range $peer, $error := .Unreachable}}<div class="alert alert-danger small">Unreachable: {{$peer}} {{$error}}</div>{{end}}
+{{if .Tags}}<h5>At risk tags</h5>
+{{range .Tags}}<div><a class="btn btn-outline-danger" href="tag/{{.Tag}}">{{.Tag}} <span class="badge badge-dark">{{.AtRisk}} of {{.Total}}</span></a></div>
+{{end}}{{end}}
+{{if .AtRisk}}<h5>At risk assets</h5>
+{{range .AtRisk}}<div class="card card-body mb-2"><a href="info/{{.Asset}}">{{.Filename}}</a>
+<div class="small">Copies: {{.Copies}}{{range .Peers}} <a href="{{.}}">{{.}}</a>{{end}}</div></div>
+{{end}}{{end}}
+{{end}}
+`
+
+var replicationHTMLTmpl = template.Must(template.New("replication").Parse(replicationHTMLTemplate))
+
+func httpReplication(w http.ResponseWriter, r *http.Request) {
+	report, err := loadReplicationReport()
+	if err != nil && !os.IsNotExist(err) {
+		httpHandle500(w, err)
+		return
+	}
+	if httpNotModified(w, r) {
+		return
+	}
+	output, err := headHTML(0)
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	var rendered strings.Builder
+	if err = replicationHTMLTmpl.Execute(&rendered, report); err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	output += rendered.String() + footerHTML()
+	if _, err = io.WriteString(w, output); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFormatReplicationReport(t *testing.T) {
+	report := replicationReport{MinimumCopies: 2,
+		TotalAssets: 3,
+		Peers:       []string{"https://a.example.com/"},
+		Unreachable: map[string]string{"https://b.example.com/": "connection refused"},
+		AtRisk:      []assetReplication{{Asset: "d2a8", Filename: "hello", Copies: 1}},
+		Tags:        []tagReplication{{Tag: "foo", AtRisk: 1, Total: 2}}}
+	expected := []string{"1 of 3 assets have fewer than 2 copies, checked 1 peers.",
+		"Unreachable peer: https://b.example.com/ connection refused",
+		"At risk tag: foo 1 of 2",
+		"d2a8 1 hello"}
+	output := formatReplicationReport(report)
+	if len(output) != len(expected) {
+		t.Fatalf("Expected %d lines, got %v", len(expected), output)
+	}
+	for index := range expected {
+		if output[index] != expected[index] {
+			t.Errorf("Expected %q, got %q", expected[index], output[index])
+		}
+	}
+}
+
+func TestParseMinimumCopies(t *testing.T) {
+	if copies, err := parseMinimumCopies("3"); err != nil || copies != 3 {
+		t.Errorf("Expected 3, got %d %v", copies, err)
+	}
+	for _, copies := range []string{"0", "-1", "many"} {
+		if _, err := parseMinimumCopies(copies); err == nil {
+			t.Errorf("%s should not be accepted", copies)
+		}
+	}
+}
+
+func TestPeerCopies(t *testing.T) {
+	served := map[string]string{"aa": "12345", "bb": "123"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest" {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/asset/") {
+			contents, ok := served[strings.TrimPrefix(r.URL.Path, "/asset/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(contents))
+		}
+	}))
+	defer server.Close()
+	// bb is served at the wrong size and cc not at all.
+	held, err := peerCopies(server.URL+"/", map[string]int64{"aa": 5, "bb": 4, "cc": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(held) != 1 || !held["aa"] {
+		t.Errorf("Expected only aa to be held, got %v", held)
+	}
+}
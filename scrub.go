@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A scrub rehashes assets with a pool of workers and reports every problem
+// it finds, instead of stopping at the first like validate_assets. Each
+// asset records when it last hashed correctly, so a scrub can skip assets
+// verified recently. That's how an interrupted scrub picks up where it left
+// off, and how web mode scrubs a little at a time.
+
+type scrubResult struct {
+	Checked  int
+	Skipped  int
+	Problems []doctorProblem
+}
+
+func getAssetFilePathVerifiedAt(asset string) string {
+	return metadataDir() + "/" + asset + "/verified"
+}
+
+var (
+	// Web mode can't write metadata once it drops privileges, so it
+	// remembers here what it verified.
+	verifiedAt      = make(map[string]time.Time)
+	verifiedAtMutex sync.Mutex
+)
+
+func getAssetVerifiedAt(asset string) (verified time.Time, err error) {
+	verifiedAtMutex.Lock()
+	verified, ok := verifiedAt[asset]
+	verifiedAtMutex.Unlock()
+	if ok {
+		return
+	}
+	verifiedByte, err := ioutil.ReadFile(getAssetFilePathVerifiedAt(asset))
+	if err != nil {
+		return
+	}
+	return time.Parse(time.RFC3339, strings.Trim(string(verifiedByte), "\n"))
+}
+
+func setAssetVerifiedAt(asset string, verified time.Time) {
+	verifiedAtMutex.Lock()
+	verifiedAt[asset] = verified
+	verifiedAtMutex.Unlock()
+	// Best effort, we may be read only in web mode.
+	err := init_metadata(asset)
+	if err == nil {
+		err = ioutil.WriteFile(getAssetFilePathVerifiedAt(asset), []byte(verified.UTC().Format(time.RFC3339)+"\n"), 0644)
+	}
+	if err != nil && !inChroot {
+		log.Printf("Unable to record when %s was verified: %s", asset, err.Error())
+	}
+}
+
+// An asset that fails a scrub isn't verified any more, whenever it last was.
+func clearAssetVerifiedAt(asset string) {
+	verifiedAtMutex.Lock()
+	verifiedAt[asset] = time.Time{}
+	verifiedAtMutex.Unlock()
+	if err := os.Remove(getAssetFilePathVerifiedAt(asset)); err != nil && !os.IsNotExist(err) && !inChroot {
+		log.Printf("Unable to clear when %s was verified: %s", asset, err.Error())
+	}
+}
+
+// Shared by every reader it wraps, so all of them together stay under the limit.
+type rateLimiter struct {
+	mutex          sync.Mutex
+	bytesPerSecond int64
+	// When what we've already let through will have been paid for.
+	next time.Time
+}
+
+// No limit if bytesPerSecond isn't positive.
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+func (limiter *rateLimiter) wait(n int) {
+	if limiter == nil {
+		return
+	}
+	limiter.mutex.Lock()
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	limiter.next = limiter.next.Add(time.Duration(n) * time.Second / time.Duration(limiter.bytesPerSecond))
+	delay := limiter.next.Sub(now)
+	limiter.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (reader limitedReader) Read(p []byte) (n int, err error) {
+	n, err = reader.reader.Read(p)
+	reader.limiter.wait(n)
+	return
+}
+
+// One per CPU unless scrub_workers says otherwise.
+func scrubWorkers() int {
+	workers, err := strconv.Atoi(getSetting("scrub_workers"))
+	if err != nil || workers < 1 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
+
+func scrubBandwidth() int64 {
+	kibibytes, _ := strconv.ParseInt(getSettingOrDefault("scrub_bandwidth"), 10, 64)
+	return kibibytes * 1024
+}
+
+func scrubInterval() time.Duration {
+	hours, _ := strconv.Atoi(getSettingOrDefault("scrub_interval"))
+	return time.Duration(hours) * time.Hour
+}
+
+func parseScrubMaxAge(hours string) (maxAge time.Duration, err error) {
+	parsed, err := strconv.Atoi(hours)
+	if err != nil || parsed <= 0 {
+		err = errors.New("Max age must be a positive number of hours.")
+		return
+	}
+	maxAge = time.Duration(parsed) * time.Hour
+	return
+}
+
+// Tags by asset from the tag directories, read once rather than per asset.
+func forwardTagIndex() (index map[string][]string, err error) {
+	index = make(map[string][]string)
+	all_tags, err := tags()
+	if err != nil {
+		return
+	}
+	for _, tag := range all_tags {
+		tag_assets, err := assets_by_tag(tag)
+		if err != nil {
+			return nil, err
+		}
+		for _, asset := range tag_assets {
+			index[asset] = append(index[asset], tag)
+		}
+	}
+	return
+}
+
+// Assets with metadata or in a tag that the store doesn't have.
+func missingAssets(index map[string][]string) (missing []string, err error) {
+	names, err := list_directory(metadataDir())
+	if err != nil {
+		return
+	}
+	for asset := range index {
+		names = append(names, asset)
+	}
+	seen := make(map[string]bool)
+	for _, asset := range names {
+		if seen[asset] {
+			continue
+		}
+		seen[asset] = true
+		if !validate_asset(asset) || !assetExists(asset) {
+			missing = append(missing, asset)
+		}
+	}
+	return
+}
+
+func tagsMatch(forward_tags []string, back_tags []string) bool {
+	if len(forward_tags) != len(back_tags) {
+		return false
+	}
+	for index := range forward_tags {
+		if forward_tags[index] != back_tags[index] {
+			return false
+		}
+	}
+	return true
+}
+
+// Rehashes assets that haven't been verified within maxAge, or all of them
+// if maxAge is 0. Tags are checked for every asset, that part is cheap.
+func scrub(maxAge time.Duration) (result scrubResult, err error) {
+	// Ask for the passphrase before the workers all want it.
+	if storeEncrypted() {
+		if _, err = getStoreKeys(); err != nil {
+			return
+		}
+	}
+	all_assets, err := assets()
+	if err != nil {
+		return
+	}
+	index, err := forwardTagIndex()
+	if err != nil {
+		return
+	}
+	missing, err := missingAssets(index)
+	if err != nil {
+		return
+	}
+	for _, asset := range missing {
+		result.Problems = append(result.Problems, doctorProblem{"Missing", asset})
+	}
+	// Before the workers start, since they add to result.Problems too.
+	for _, asset := range all_assets {
+		// Untagged assets have no back tags directory.
+		back_tags, _ := back_tags_by_asset(asset)
+		if !tagsMatch(index[asset], back_tags) {
+			result.Problems = append(result.Problems, doctorProblem{"Tags do not match", asset})
+		}
+	}
+	limiter := newRateLimiter(scrubBandwidth())
+	var mutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	jobs := make(chan string)
+	for worker := 0; worker < scrubWorkers(); worker++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for asset := range jobs {
+				err := checkAssetHashLimited(asset, limiter)
+				if err == nil {
+					setAssetVerifiedAt(asset, time.Now())
+				} else {
+					clearAssetVerifiedAt(asset)
+				}
+				mutex.Lock()
+				result.Checked++
+				if err != nil {
+					result.Problems = append(result.Problems, doctorProblem{"Corrupt", asset + " (" + err.Error() + ")"})
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, asset := range all_assets {
+		if maxAge != 0 {
+			if verified, err := getAssetVerifiedAt(asset); err == nil && time.Since(verified) < maxAge {
+				result.Skipped++
+				continue
+			}
+		}
+		jobs <- asset
+	}
+	close(jobs)
+	waitGroup.Wait()
+	sort.Slice(result.Problems, func(i, j int) bool {
+		if result.Problems[i].Category != result.Problems[j].Category {
+			return result.Problems[i].Category < result.Problems[j].Category
+		}
+		return result.Problems[i].Subject < result.Problems[j].Subject
+	})
+	return
+}
+
+// Runs in web mode if scrub_interval is set, scrubbing whatever hasn't been
+// verified in the last interval.
+func scrubLoop(interval time.Duration) {
+	for {
+		if storeLocked() {
+			log.Print("Store is locked, not scrubbing.")
+		} else {
+			result, err := scrub(interval)
+			for _, problem := range result.Problems {
+				log.Print("Scrub found ", problem.String())
+			}
+			if err != nil {
+				log.Print("Scrub failed: ", err.Error())
+			} else {
+				log.Printf("Scrubbed %d assets, %d problems.", result.Checked, len(result.Problems))
+			}
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTagsMatch(t *testing.T) {
+	if !tagsMatch(nil, nil) || !tagsMatch([]string{"a", "b"}, []string{"a", "b"}) {
+		t.Errorf("Same tags should match")
+	}
+	if tagsMatch([]string{"a"}, nil) || tagsMatch([]string{"a", "b"}, []string{"a", "c"}) {
+		t.Errorf("Different tags should not match")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0) != nil {
+		t.Errorf("0 should be no limit")
+	}
+	// A nil limiter doesn't wait.
+	var unlimited *rateLimiter
+	unlimited.wait(1 << 30)
+	limiter := newRateLimiter(1000000)
+	start := time.Now()
+	limiter.wait(50000)
+	limiter.wait(50000)
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("100000 bytes at 1000000 per second should take 100ms, not %s", elapsed)
+	}
+}
+
+func TestParseScrubMaxAge(t *testing.T) {
+	if maxAge, err := parseScrubMaxAge("24"); err != nil || maxAge != 24*time.Hour {
+		t.Errorf("24 should be a day: %s %v", maxAge, err)
+	}
+	for _, hours := range []string{"", "0", "-1", "1.5", "day"} {
+		if _, err := parseScrubMaxAge(hours); err == nil {
+			t.Errorf("%s should not be a valid max age", hours)
+		}
+	}
+}
+
+func TestScrubProblems(t *testing.T) {
+	t.Setenv("DECENSOR_DIR", t.TempDir()+"/store")
+	if err := init_folders(); err != nil {
+		t.Fatal(err)
+	}
+	if err := setSetting("scrub_workers", "8"); err != nil {
+		t.Fatal(err)
+	}
+	source := t.TempDir() + "/source"
+	var corrupt []string
+	for i := 0; i < 40; i++ {
+		if err := ioutil.WriteFile(source, []byte(strconv.Itoa(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		asset, err := add(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tag(asset, []string{"scrubtag"}); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			continue
+		}
+		// Every other asset is corrupt and has lost its back tag.
+		if err = ioutil.WriteFile(getAssetPath(asset), []byte("corrupt"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Remove(getAssetFilePathTags(asset) + "scrubtag"); err != nil {
+			t.Fatal(err)
+		}
+		corrupt = append(corrupt, asset)
+	}
+	result, err := scrub(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 40 {
+		t.Errorf("Should check all 40 assets, not %d", result.Checked)
+	}
+	counts := make(map[string]int)
+	for _, problem := range result.Problems {
+		counts[problem.Category]++
+	}
+	if counts["Corrupt"] != len(corrupt) || counts["Tags do not match"] != len(corrupt) || len(result.Problems) != 2*len(corrupt) {
+		t.Errorf("Should find %d corrupt assets and %d tag mismatches: %v", len(corrupt), len(corrupt), counts)
+	}
+}
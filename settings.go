@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Settings live as one file per setting under settingsDir(), like metadata.
+var knownSettings = map[string]string{
+	"theme_css":        "Asset to use as the web UI stylesheet instead of the built in one.",
+	"site_title":       "Title shown in the web UI header.",
+	"site_description": "Description shown under the title in the web UI header.",
+	"source_url":       "Where the web UI says the source code is available.",
+	"base_url":         "Public URL of the web UI, like https://example.com/, for feeds. Guessed from requests if unset.",
+	"hash_algorithm":   "Multihash algorithm new assets are named by: sha2-256, sha2-512 or blake2b-256.",
+	"chunk_store":      "on to store new assets as deduplicated chunks, off to store them as files.",
+	"compress_at_rest": "on to gzip new textual assets in the store when it saves space.",
+	"scrub_interval":   "Hours between scrubs in web mode, 0 to not scrub.",
+	"scrub_workers":    "How many assets a scrub hashes at once. One per CPU if unset.",
+	"scrub_bandwidth":  "KiB per second a scrub reads at most, 0 for no limit.",
+}
+
+var defaultSettings = map[string]string{
+	"site_title":       "Decensor",
+	"site_description": "Checksum-based file tracking and tagging",
+	"source_url":       "https://github.com/teran-mckinney/decensor",
+	"hash_algorithm":   defaultHashAlgorithm,
+	"chunk_store":      "off",
+	"compress_at_rest": "off",
+	"scrub_interval":   "0",
+	"scrub_bandwidth":  "0",
+}
+
+func validateSetting(name string, value string) error {
+	if _, ok := knownSettings[name]; !ok {
+		return errors.New("Unknown setting: " + name)
+	}
+	if value == "" {
+		return nil
+	}
+	if strings.Contains(value, "\n") {
+		return errors.New("Settings must be a single line.")
+	}
+	switch name {
+	case "base_url":
+		parsed, err := url.Parse(value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return errors.New("base_url must be an absolute http or https URL.")
+		}
+	case "hash_algorithm":
+		if _, err := getHashAlgorithm(value); err != nil {
+			return err
+		}
+	case "chunk_store", "compress_at_rest":
+		if value != "on" && value != "off" {
+			return errors.New(name + " must be on or off.")
+		}
+	case "scrub_interval", "scrub_bandwidth":
+		if number, err := strconv.Atoi(value); err != nil || number < 0 {
+			return errors.New(name + " must be 0 or a positive number.")
+		}
+	case "scrub_workers":
+		if number, err := strconv.Atoi(value); err != nil || number < 1 {
+			return errors.New(name + " must be a positive number.")
+		}
+	case "theme_css":
+		if err := validateAsset(value); err != nil {
+			return err
+		}
+		if !assetExists(value) {
+			return errors.New("Asset does not exist, add it first.")
+		}
+	}
+	return nil
+}
+
+func getSetting(name string) (value string) {
+	valueByte, err := ioutil.ReadFile(settingsDir() + "/" + name)
+	if err == nil {
+		value = strings.Trim(string(valueByte), "\n")
+	}
+	return
+}
+
+func getSettingOrDefault(name string) string {
+	if value := getSetting(name); value != "" {
+		return value
+	}
+	return defaultSettings[name]
+}
+
+// base_url with exactly one trailing slash, or "" if it isn't set.
+func getBaseURL() string {
+	if baseURL := getSetting("base_url"); baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/") + "/"
+	}
+	return ""
+}
+
+// Setting a value of "" removes the setting.
+func setSetting(name string, value string) error {
+	var err error
+	if name == "theme_css" && value != "" {
+		// Store the asset under the name it's stored as, whatever form we got.
+		if asset, resolveErr := resolveAsset(value); resolveErr == nil {
+			value = asset
+		}
+	}
+	if err = validateSetting(name, value); err != nil {
+		return err
+	}
+	path := settingsDir() + "/" + name
+	if value == "" {
+		if err = os.Remove(path); os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	// Stores from before settings existed won't have the directory.
+	if err = os.MkdirAll(settingsDir(), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(value+"\n"), 0644)
+}
+
+func settings() (output []string) {
+	var names []string
+	for name := range knownSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		output = append(output, name+"="+getSettingOrDefault(name)+" # "+knownSettings[name])
+	}
+	return
+}
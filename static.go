@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files the web UI needs, built into the binary so it works on an empty store.
+//
+//go:embed static LICENSE
+var staticFS embed.FS
+
+type staticFile struct {
+	content []byte
+	hash    string
+}
+
+// Keyed by the name served under /static/.
+var staticFiles = make(map[string]staticFile)
+
+func init() {
+	for _, name := range []string{"static/decensor.css", "LICENSE"} {
+		content, err := staticFS.ReadFile(name)
+		fatal_error(err)
+		hash := sha256.Sum256(content)
+		staticFiles[path.Base(name)] = staticFile{content: content, hash: hex.EncodeToString(hash[:])}
+	}
+}
+
+// Relative URL for a static file. The version query changes whenever the
+// file does, which is what lets us tell browsers to cache it forever.
+func staticURL(name string) string {
+	return "static/" + name + "?v=" + staticFiles[name].hash[:16]
+}
+
+func httpStatic(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	file, ok := staticFiles[name]
+	if !ok {
+		http.Error(w, "No such static file.", http.StatusNotFound)
+		return
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	if mimeType == "" {
+		mimeType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", "\""+file.hash+"\"")
+	// ServeContent handles If-None-Match and Range for us.
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(file.content))
+}
+
+// Stylesheet for the web UI, relative to the site root. An operator can
+// swap it out for any stored asset with the theme_css setting.
+func themeCSSURL() string {
+	if theme := getSetting("theme_css"); theme != "" {
+		if validate_asset(theme) {
+			return "asset/" + theme
+		}
+		log.Printf("Ignoring invalid theme_css setting: %s", theme)
+	}
+	return staticURL("decensor.css")
+}
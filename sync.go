@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sync pulls assets and tags from a mirror's signed manifest. Only manifests
+// signed by a publisher in our keyring are imported. Anything else is refused,
+// or held in quarantineDir() for an operator to release or reject.
+
+func quarantineDir() string {
+	return baseDir() + "/quarantine"
+}
+
+func getQuarantinePath(asset string) string {
+	return quarantineDir() + "/" + asset
+}
+
+// Tags come from other people's manifests, so keep them to names that are
+// safe to use as a directory.
+func validateTagName(tag string) error {
+	if tag == "" || strings.Contains(tag, "/") || strings.HasPrefix(tag, ".") || strings.Contains(tag, "\n") {
+		return errors.New("Invalid tag name: " + tag)
+	}
+	return nil
+}
+
+// Takes a mirror's root, with or without the trailing slash, or its manifest.
+func mirrorManifestURL(source string) (manifestURL string, root string) {
+	manifestURL = source
+	if !strings.HasSuffix(manifestURL, "/manifest") {
+		manifestURL = strings.TrimSuffix(manifestURL, "/") + "/manifest"
+	}
+	root = strings.TrimSuffix(manifestURL, "manifest")
+	return
+}
+
+// Fetches a mirror's manifest and checks it is signed by the key it claims.
+func fetchMirrorManifest(manifestURL string) (contents signedManifest, publicKey string, err error) {
+	manifest, err := readSource(manifestURL)
+	if err != nil {
+		return
+	}
+	signature, err := readSource(manifestURL + ".sig")
+	if err != nil {
+		return
+	}
+	var claimed signedManifest
+	if err = json.Unmarshal(manifest, &claimed); err != nil {
+		return
+	}
+	if publicKey, err = manifestPublicKey(claimed); err != nil {
+		return
+	}
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return
+	}
+	contents, err = checkManifestSignature(manifest, signature, key)
+	return
+}
+
+// Downloads an asset from a mirror into directory, returning the path of a
+// temporary file that is known to match the asset's hash.
+func downloadAsset(root string, asset string, directory string) (path string, err error) {
+	algorithm, _, err := assetAlgorithmAndDigest(asset)
+	if err != nil {
+		return
+	}
+	body, err := httpGetAsset(root + "asset/" + asset)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	fd, err := ioutil.TempFile(directory, ".download-")
+	if err != nil {
+		return
+	}
+	path = fd.Name()
+	hash, err := hashReader(io.TeeReader(body, fd), algorithm)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hash != asset {
+		err = fmt.Errorf("%s does not match %s", hash, asset)
+	}
+	if err != nil {
+		os.Remove(path)
+		path = ""
+	}
+	return
+}
+
+// Downloads an asset into the store. With the chunk store on, mirrors that
+// keep the asset chunked only send us the chunks we don't have.
+func fetchAsset(root string, asset string) (err error) {
+	if chunkStoreEnabled() {
+		found, err := downloadChunkedAsset(root, asset)
+		if found || err != nil {
+			return err
+		}
+	}
+	path, err := downloadAsset(root, asset, baseDir())
+	if err != nil {
+		return
+	}
+	if err = storeAssetFile(asset, path); err != nil {
+		os.Remove(path)
+	}
+	return
+}
+
+func importMirrorAsset(item manifestAsset, root string, publicKey string) (err error) {
+	if !assetExists(item.Asset) {
+		if err = fetchAsset(root, item.Asset); err != nil {
+			return
+		}
+		if err = addAssetMetadata(item.Asset, filepath.Base(item.Filename)); err != nil {
+			return
+		}
+	}
+	if err = tagMissing(item.Asset, item.Tags); err != nil {
+		return
+	}
+	if err = attest(item.Asset, publicKey); err != nil {
+		return
+	}
+	// A trusted publisher vouching for it settles anything held in quarantine.
+	if _, err = os.Stat(getQuarantinePath(item.Asset)); err == nil {
+		return reject(item.Asset)
+	}
+	return nil
+}
+
+// Adds only the tags an asset doesn't have yet.
+func tagMissing(asset string, tags []string) error {
+	existing := make(map[string]bool)
+	for _, tag := range tags_by_asset(asset) {
+		existing[tag] = true
+	}
+	var missing []string
+	for _, tag := range tags {
+		if !existing[tag] {
+			missing = append(missing, tag)
+		}
+	}
+	return tag(asset, missing)
+}
+
+func quarantineMirrorAsset(item manifestAsset, root string, publicKey string, source string) (err error) {
+	if assetExists(item.Asset) {
+		// Already have it, an untrusted manifest can't add tags though.
+		return
+	}
+	directory := getQuarantinePath(item.Asset)
+	if _, err = os.Stat(directory); err == nil {
+		return
+	}
+	if err = os.MkdirAll(quarantineDir(), 0755); err != nil {
+		return
+	}
+	path, err := downloadAsset(root, item.Asset, quarantineDir())
+	if err != nil {
+		return
+	}
+	if err = os.Mkdir(directory, 0755); err != nil {
+		os.Remove(path)
+		return
+	}
+	if err = os.Rename(path, directory+"/content"); err != nil {
+		os.Remove(path)
+		return
+	}
+	values := map[string]string{"filename": filepath.Base(item.Filename),
+		"tags":      strings.Join(item.Tags, "\n"),
+		"publisher": publicKey,
+		"source":    source}
+	for name, value := range values {
+		if err = ioutil.WriteFile(directory+"/"+name, []byte(value+"\n"), 0644); err != nil {
+			return
+		}
+	}
+	return
+}
+
+type syncResult struct {
+	// Assets in the mirror's manifest.
+	Assets int
+	// Assets we now have (or hold in quarantine).
+	Synced int
+	// Assets we couldn't get or that didn't verify.
+	Failed int
+}
+
+// Imports everything a trusted publisher's manifest vouches for. With
+// quarantine, assets from untrusted publishers are held instead of refused.
+func syncFromMirror(source string, quarantine bool) (result syncResult, err error) {
+	manifestURL, root := mirrorManifestURL(source)
+	if !isURL(manifestURL) {
+		err = errors.New("Mirrors must be http or https URLs.")
+		return
+	}
+	contents, publicKey, err := fetchMirrorManifest(manifestURL)
+	if err != nil {
+		return
+	}
+	publisher, trusted := getTrustedPublisher(publicKey)
+	if !trusted && !quarantine {
+		err = fmt.Errorf("Manifest is signed by %s, which is not trusted. Refusing to sync.", publicKey)
+		return
+	}
+	if trusted {
+		log.Printf("Manifest is signed by %s.", publisher)
+	} else {
+		log.Printf("Manifest is signed by untrusted key %s, quarantining.", publicKey)
+	}
+	result.Assets = len(contents.Assets)
+	for _, item := range contents.Assets {
+		if err = validateAsset(item.Asset); err == nil {
+			for _, tag := range item.Tags {
+				if err = validateTagName(tag); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			if trusted {
+				err = importMirrorAsset(item, root, publicKey)
+			} else {
+				err = quarantineMirrorAsset(item, root, publicKey, manifestURL)
+			}
+		}
+		if err != nil {
+			log.Printf("%s (%s): %s", item.Asset, item.Filename, err.Error())
+			result.Failed++
+			// A peer that stopped answering won't do better for the rest.
+			if isTimeout(err) {
+				result.Failed = result.Assets - result.Synced
+				err = fmt.Errorf("Gave up with %d of %d assets left to sync: %s", result.Failed, result.Assets, err.Error())
+				return
+			}
+			continue
+		}
+		result.Synced++
+	}
+	err = nil
+	if result.Failed != 0 {
+		err = fmt.Errorf("%d of %d assets failed to sync.", result.Failed, result.Assets)
+	}
+	return
+}
+
+func getQuarantineValue(asset string, name string) string {
+	valueByte, err := ioutil.ReadFile(getQuarantinePath(asset) + "/" + name)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(string(valueByte), "\n")
+}
+
+// Lists quarantined assets as "<asset> <filename> <publisher> <source>".
+func quarantined() (output []string, err error) {
+	quarantined_assets, err := list_directory(quarantineDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	for _, asset := range quarantined_assets {
+		if validate_asset(asset) {
+			output = append(output, strings.Join([]string{asset,
+				getQuarantineValue(asset, "filename"),
+				getQuarantineValue(asset, "publisher"),
+				getQuarantineValue(asset, "source")}, " "))
+		}
+	}
+	return
+}
+
+// Moves a quarantined asset into the store, with its tags, on the operator's say so.
+func release(asset string) (err error) {
+	if err = validateAsset(asset); err != nil {
+		return
+	}
+	directory := getQuarantinePath(asset)
+	if _, err = os.Stat(directory); os.IsNotExist(err) {
+		return errors.New("Asset is not quarantined.")
+	}
+	if assetExists(asset) {
+		return reject(asset)
+	}
+	if err = storeAssetFile(asset, directory+"/content"); err != nil {
+		return
+	}
+	if err = addAssetMetadata(asset, getQuarantineValue(asset, "filename")); err != nil {
+		return
+	}
+	var asset_tags []string
+	if tags := getQuarantineValue(asset, "tags"); tags != "" {
+		asset_tags = strings.Split(tags, "\n")
+	}
+	if err = tagMissing(asset, asset_tags); err != nil {
+		return
+	}
+	// It's still only the untrusted publisher who vouched for it.
+	if publicKey := getQuarantineValue(asset, "publisher"); validatePublicKeyHex(publicKey) == nil {
+		if err = attest(asset, publicKey); err != nil {
+			return
+		}
+	}
+	return reject(asset)
+}
+
+// Deletes a quarantined asset.
+func reject(asset string) (err error) {
+	if err = validateAsset(asset); err != nil {
+		return
+	}
+	directory := getQuarantinePath(asset)
+	if _, err = os.Stat(directory); os.IsNotExist(err) {
+		return errors.New("Asset is not quarantined.")
+	}
+	return os.RemoveAll(directory)
+}
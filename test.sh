@@ -10,6 +10,12 @@ cleanup() {
     if [ -n "$PID" ]; then
         kill "$PID" || true
     fi
+    if [ -n "$RECEIVE_PID" ]; then
+        kill "$RECEIVE_PID" || true
+    fi
+    if [ -n "$ENCRYPTED_PID" ]; then
+        kill "$ENCRYPTED_PID" || true
+    fi
     rm -r "$TEST_DECENSOR_DIR" || true
     rm -r "$TEST_SCRAP_DIR" || true
 }
@@ -46,6 +52,20 @@ echo Hello\ World > "$TEST_SCRAP_DIR"/hello
 
 ./decensor add "$TEST_SCRAP_DIR"/hello || fail "Unable to add Hello World"
 
+./decensor lookup e59ff97941044f85df5297e1c302d260 | grep d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26 || fail "Should find Hello World by MD5"
+
+./decensor info QmcWyBPyedDzHFytTX6CAjjpvqQAyhzURziwiBKDKgqx6R | grep Filename || fail "Should accept a base58 multihash"
+
+./decensor info 1220d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26 | grep Filename || fail "Should accept a hex multihash"
+
+./decensor set_setting hash_algorithm md4 && fail "Should not accept an unknown hash algorithm"
+
+./decensor set_setting hash_algorithm sha2-512 || fail "Should be able to set hash_algorithm"
+
+[ "$(./decensor hash "$TEST_SCRAP_DIR"/hello | cut -c 1-4)" = "1340" ] || fail "Should hash with SHA-512 multihash"
+
+./decensor set_setting hash_algorithm "" || fail "Should be able to unset hash_algorithm"
+
 [ -f "$TEST_DECENSOR_DIR"/assets/d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26 ] || fail "Hello World hash not found."
 
 ./decensor add "$TEST_SCRAP_DIR"/hello && fail "Should not be able to add same file twice."
@@ -111,7 +131,11 @@ echo Hello\ World > "$TEST_SCRAP_DIR"/hello
 
 find "$DECENSOR_DIR"
 
-[ "$(find "$DECENSOR_DIR" | wc -l)" -eq 15 ] || fail "Found more files than expected after remove."
+[ "$(find "$DECENSOR_DIR" | wc -l)" -eq 23 ] || fail "Found more files than expected after remove."
+
+./decensor log | grep "remove d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26" || fail "Remove should be in the journal"
+
+[ "$(./decensor log --since 6 | head -n 1 | cut -d ' ' -f 1)" = "7" ] || fail "log --since should start after the sequence number"
 
 ./decensor add "$TEST_SCRAP_DIR"/hello || fail "Unable to add Hello World"
 
@@ -125,6 +149,9 @@ rm -r "$DECENSOR_DIR"/metadata/d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df2745
 ./decensor web :4999 &
 PID=$!
 
+# Web mode hashes anything it has to before it listens.
+sleep 1
+
 curl -so /dev/null --show-error --fail "http://localhost:4999/assets/" || fail "404 for assets?"
 
 curl -so /dev/null --show-error --fail "http://localhost:4999/tag/no_tag" && fail "No 404 for no tag?"
@@ -133,6 +160,10 @@ curl -so /dev/null --show-error --fail "http://localhost:4999/tags/whatever" ||
 
 curl -so /dev/null --show-error --fail "http://localhost:4999/tags/" || fail "404 for tags?"
 
+curl -s --show-error --fail "http://localhost:4999/changes?since=0" | grep '"op":"add"' || fail "Changes should list adds"
+
+curl -so /dev/null --show-error --fail "http://localhost:4999/changes?since=nope" && fail "Changes should reject a bad since"
+
 ## Make sure CSS is returned as CSS.
 
 echo 'a:' > "$TEST_SCRAP_DIR/foo.css"
@@ -151,6 +182,16 @@ echo '# I am Markdown' > "$TEST_SCRAP_DIR/foo.md"
 
 curl -I -s --show-error --fail "http://localhost:4999/asset/c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3" | grep text/plain || fail "Invalid content type for Markdown"
 
+## Mime type overrides
+
+./decensor set_mime c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3 notamimetype && fail "Should not accept an invalid mime type"
+
+./decensor set_mime c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3 text/markdown || fail "Should be able to set a mime type"
+
+curl -I -s --show-error --fail "http://localhost:4999/asset/c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3" | grep text/markdown || fail "Mime type override not honored"
+
+##
+
 ./decensor tag c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3 foo || fail "Should be able to tag"
 
 ./decensor validate_assets || fail "assets should be valid"
@@ -163,6 +204,283 @@ rm -r "$DECENSOR_DIR/metadata/c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8
 
 ./decensor validate_assets || fail "assets should be valid"
 
+## Doctor
+
+# Removing assets earlier leaves empty tags behind.
+./decensor doctor --fix || fail "Doctor should tidy up after earlier tests"
+
+./decensor doctor || fail "Store should be healthy"
+
+./decensor tag c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3 doctortag || fail "Should be able to tag"
+
+rm "$DECENSOR_DIR/metadata/c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3/tags/doctortag"
+
+mkdir "$DECENSOR_DIR/tags/emptytag"
+
+touch "$DECENSOR_DIR/tags/foo/0000000000000000000000000000000000000000000000000000000000000000"
+
+mkdir "$DECENSOR_DIR/metadata/1111111111111111111111111111111111111111111111111111111111111111"
+
+touch -d "2 hours ago" "$DECENSOR_DIR/journal.tmp"
+
+./decensor doctor > "$TEST_SCRAP_DIR/doctor" && fail "Doctor should find problems"
+
+for PROBLEM in "Back tags do not match: c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3" "Empty tag: emptytag" "Dangling tag link: foo/0000000000000000000000000000000000000000000000000000000000000000" "Orphaned metadata: 1111111111111111111111111111111111111111111111111111111111111111" "Temporary file: journal.tmp"; do
+    grep -x "$PROBLEM" "$TEST_SCRAP_DIR/doctor" || fail "Doctor should report $PROBLEM"
+done
+
+./decensor doctor --fix | grep "^Fixed 5 problems.$" || fail "Doctor should fix every problem"
+
+./decensor doctor || fail "Store should be healthy after doctor --fix"
+
+./decensor validate_assets || fail "assets should be valid after doctor --fix"
+
+## Scrub
+
+./decensor scrub | grep "^Scrubbed [0-9]* assets, skipped 0 verified recently, found 0 problems.$" || fail "Scrub should check every asset"
+
+./decensor scrub 24 | grep "^Scrubbed 0 assets" || fail "Scrub should skip assets verified recently"
+
+cp "$DECENSOR_DIR/assets/c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3" "$TEST_SCRAP_DIR/scrubbed"
+
+echo Corrupted >> "$DECENSOR_DIR/assets/c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3"
+
+rm "$DECENSOR_DIR/metadata/c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3/tags/foo"
+
+./decensor set_setting scrub_workers 2 || fail "Should be able to set scrub workers"
+
+./decensor set_setting scrub_bandwidth 1024 || fail "Should be able to set a scrub bandwidth limit"
+
+./decensor scrub > "$TEST_SCRAP_DIR/scrub" && fail "Scrub should find problems"
+
+grep "^Corrupt: c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3 " "$TEST_SCRAP_DIR/scrub" || fail "Scrub should report the corrupt asset"
+
+grep -x "Tags do not match: c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3" "$TEST_SCRAP_DIR/scrub" || fail "Scrub should report the tag mismatch too"
+
+cp "$TEST_SCRAP_DIR/scrubbed" "$DECENSOR_DIR/assets/c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3"
+
+./decensor back_tag_all_assets || fail "should be able to back tag all assets"
+
+./decensor scrub 24 | grep "^Scrubbed 1 assets, skipped [0-9]* verified recently, found 0 problems.$" || fail "Scrub should only recheck the asset that failed"
+
+./decensor set_setting scrub_workers "" || fail "Should be able to unset scrub workers"
+
+./decensor set_setting scrub_bandwidth "" || fail "Should be able to unset the scrub bandwidth limit"
+
+##
+
+## Signed manifests
+
+curl -so /dev/null --show-error --fail "http://localhost:4999/manifest" && fail "No manifest should 404 before signing"
+
+./decensor sign && fail "Should not be able to sign without a key"
+
+PUBLIC_KEY="$(./decensor keygen)" || fail "Should be able to generate a key"
+
+./decensor keygen && fail "Should not overwrite an existing key"
+
+./decensor sign || fail "Should be able to sign"
+
+./decensor log | tail -n 1 | grep " sign public_key=$PUBLIC_KEY$" || fail "Signing should be in the journal, so peers fetch the new manifest"
+
+./decensor verify_manifest "http://localhost:4999/manifest" "$PUBLIC_KEY" || fail "Manifest should verify"
+
+./decensor verify_manifest "$DECENSOR_DIR/manifest" "$DECENSOR_DIR/keys/public_key" || fail "Manifest file should verify"
+
+./decensor verify_manifest "http://localhost:4999/manifest" 0000000000000000000000000000000000000000000000000000000000000000 && fail "Manifest should not verify with the wrong key"
+
+## Trusted publishers
+
+./decensor sync "http://localhost:4999/" && fail "Should refuse to sync from an untrusted publisher"
+
+./decensor trust "$PUBLIC_KEY" "Test Publisher" || fail "Should be able to trust a publisher"
+
+./decensor trusted | grep "Test Publisher" || fail "Publisher should be in the keyring"
+
+./decensor sync "http://localhost:4999/" || fail "Should sync from a trusted publisher"
+
+./decensor info c8deb6b237964318040fe890deb2d8f6129cc3f3a6311e95d8553ef88791ccf3 | grep "Attested by: Test Publisher" || fail "Asset should be attested by the publisher"
+
+./decensor untrust "$PUBLIC_KEY" || fail "Should be able to untrust a publisher"
+
+./decensor untrust "$PUBLIC_KEY" && fail "Publisher should already be untrusted"
+
+## Peers
+
+./decensor peers add "http://localhost:4999" || fail "Should be able to add a peer"
+
+./decensor peers add "http://localhost:4999/manifest" && fail "Should not add the same peer twice"
+
+./decensor peers list | grep "http://localhost:4999/ last_success=never" || fail "Peer should be listed"
+
+curl -s --show-error --fail "http://localhost:4999/peers" | grep "http://localhost:4999/" || fail "Peer should be on the status page"
+
+./decensor peers remove "http://localhost:4999/" || fail "Should be able to remove a peer"
+
+## Replication report
+
+curl -s --show-error --fail "http://localhost:4999/replication" | grep "No replication report yet" || fail "Should say there's no report yet"
+
+./decensor replication_report 1 | grep "^0 of" || fail "Nothing is at risk with a minimum of one copy"
+
+./decensor replication_report | grep "have fewer than 2 copies" || fail "Everything is at risk without peers"
+
+curl -s --show-error --fail "http://localhost:4999/replication" | grep "At risk assets" || fail "Report should be on the replication page"
+
+## Chunk store
+
+./decensor set_setting chunk_store on || fail "Should be able to turn on the chunk store"
+
+head -c 1000000 /dev/urandom > "$TEST_SCRAP_DIR/chunky"
+
+CHUNKY_ASSET="$(./decensor add "$TEST_SCRAP_DIR/chunky")" || fail "Should be able to add to the chunk store"
+
+[ -f "$DECENSOR_DIR/recipes/$CHUNKY_ASSET" ] || fail "Asset should have a recipe"
+
+[ -f "$DECENSOR_DIR/assets/$CHUNKY_ASSET" ] && fail "Chunked asset should not be a file"
+
+curl -s --show-error --fail "http://localhost:4999/asset/$CHUNKY_ASSET" | cmp - "$TEST_SCRAP_DIR/chunky" || fail "Chunked asset should be served whole"
+
+curl -s --show-error --fail -r 500000-500009 "http://localhost:4999/asset/$CHUNKY_ASSET" | cmp - <(tail -c +500001 "$TEST_SCRAP_DIR/chunky" | head -c 10) || fail "Chunked asset should be served in ranges"
+
+./decensor validate_assets || fail "Chunked asset should validate"
+
+./decensor unchunk "$CHUNKY_ASSET" || fail "Should be able to unchunk"
+
+cmp "$DECENSOR_DIR/assets/$CHUNKY_ASSET" "$TEST_SCRAP_DIR/chunky" || fail "Unchunked asset should be the same"
+
+./decensor chunk || fail "Should be able to chunk everything"
+
+./decensor validate_assets || fail "Chunked assets should validate"
+
+./decensor unchunk || fail "Should be able to unchunk everything"
+
+./decensor set_setting chunk_store off || fail "Should be able to turn off the chunk store"
+
+## Compression at rest
+
+./decensor set_setting compress_at_rest on || fail "Should be able to turn on compression at rest"
+
+seq 1 100000 > "$TEST_SCRAP_DIR/numbers.csv"
+
+NUMBERS_ASSET="$(./decensor add "$TEST_SCRAP_DIR/numbers.csv")" || fail "Should be able to add a compressible asset"
+
+[ -f "$DECENSOR_DIR/compressed/$NUMBERS_ASSET" ] || fail "CSV should be compressed at rest"
+
+[ -f "$DECENSOR_DIR/assets/$NUMBERS_ASSET" ] && fail "Compressed asset should not also be a file"
+
+curl -s --show-error --fail "http://localhost:4999/asset/$NUMBERS_ASSET" | cmp - "$TEST_SCRAP_DIR/numbers.csv" || fail "Compressed asset should be served decoded"
+
+curl -s --show-error --fail -H "Accept-Encoding: gzip" "http://localhost:4999/asset/$NUMBERS_ASSET" | gunzip | cmp - "$TEST_SCRAP_DIR/numbers.csv" || fail "Compressed asset should be served gzipped"
+
+curl -s --show-error --fail -r 1000-1009 "http://localhost:4999/asset/$NUMBERS_ASSET" | cmp - <(tail -c +1001 "$TEST_SCRAP_DIR/numbers.csv" | head -c 10) || fail "Compressed asset should be served in ranges"
+
+./decensor validate_assets || fail "Compressed asset should validate"
+
+./decensor uncompress || fail "Should be able to uncompress everything"
+
+cmp "$DECENSOR_DIR/assets/$NUMBERS_ASSET" "$TEST_SCRAP_DIR/numbers.csv" || fail "Uncompressed asset should be the same"
+
+./decensor set_setting compress_at_rest off || fail "Should be able to turn off compression at rest"
+
+## Push
+
+PUSH_REMOTE_DIR="$TEST_SCRAP_DIR/push_remote"
+
+DECENSOR_DIR="$PUSH_REMOTE_DIR" ./decensor init || fail "Unable to init the push remote"
+
+PUSH_TOKEN="$(DECENSOR_DIR="$PUSH_REMOTE_DIR" ./decensor push_token)" || fail "Should be able to create a push token"
+
+DECENSOR_DIR="$PUSH_REMOTE_DIR" ./decensor receive :4998 &
+RECEIVE_PID=$!
+
+sleep 1
+
+./decensor push "http://localhost:4998/" && fail "Should not push without a token"
+
+DECENSOR_PUSH_TOKEN=wrong ./decensor push "http://localhost:4998/" && fail "Should not push with the wrong token"
+
+DECENSOR_PUSH_TOKEN="$PUSH_TOKEN" ./decensor push "http://localhost:4998/" sometag | grep "^1 of 1 assets were missing, pushed 1." || fail "Should push the sometag tag"
+
+DECENSOR_DIR="$PUSH_REMOTE_DIR" ./decensor assets_by_tag sametag | grep . || fail "Pushed assets should keep their other tags"
+
+DECENSOR_DIR="$PUSH_REMOTE_DIR" ./decensor validate_assets || fail "Pushed assets should validate"
+
+DECENSOR_PUSH_TOKEN="$PUSH_TOKEN" ./decensor push "http://localhost:4998/" sometag | grep "^0 of 1 assets were missing" || fail "Should not push the same assets twice"
+
+## Resumable uploads
+
+echo Uploaded > "$TEST_SCRAP_DIR/uploaded"
+
+DECENSOR_PUSH_TOKEN="$PUSH_TOKEN" ./decensor upload "http://localhost:4998/" "$TEST_SCRAP_DIR/uploaded" uploadtag | grep "^$(sha256sum "$TEST_SCRAP_DIR/uploaded" | cut -d ' ' -f 1)$" || fail "Upload should print the asset"
+
+DECENSOR_DIR="$PUSH_REMOTE_DIR" ./decensor assets_by_tag uploadtag | grep . || fail "Uploaded asset should be tagged"
+
+UPLOAD_ID="$(curl -s --show-error --fail -X POST -H "Authorization: Bearer $PUSH_TOKEN" "http://localhost:4998/upload?filename=chunks&size=6" | cut -d '"' -f 4)" || fail "Should be able to create an upload"
+
+curl -s --show-error --fail -X PUT -H "Authorization: Bearer $PUSH_TOKEN" --data-binary abc "http://localhost:4998/upload/$UPLOAD_ID?offset=0" || fail "Should be able to upload a chunk"
+
+curl -s --fail -X PUT -H "Authorization: Bearer $PUSH_TOKEN" --data-binary abc "http://localhost:4998/upload/$UPLOAD_ID?offset=0" && fail "Should not upload a chunk at the wrong offset"
+
+curl -s --show-error --fail -H "Authorization: Bearer $PUSH_TOKEN" "http://localhost:4998/upload/$UPLOAD_ID" | grep '"offset":3' || fail "Upload should be part way"
+
+curl -s --fail -X POST -H "Authorization: Bearer $PUSH_TOKEN" "http://localhost:4998/upload/$UPLOAD_ID/finalize?sha256=bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721" && fail "Should not finalize an incomplete upload"
+
+curl -s --show-error --fail -X PUT -H "Authorization: Bearer $PUSH_TOKEN" --data-binary def "http://localhost:4998/upload/$UPLOAD_ID?offset=3" || fail "Should be able to upload the last chunk"
+
+curl -s --show-error --fail -X POST -H "Authorization: Bearer $PUSH_TOKEN" "http://localhost:4998/upload/$UPLOAD_ID/finalize?sha256=bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721" | grep '"asset":"bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721"' || fail "Should finalize with the right SHA256"
+
+## Encryption at rest
+
+ENCRYPTED_DIR="$TEST_SCRAP_DIR/encrypted_store"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" ./decensor init || fail "Unable to init the encrypted store"
+
+echo "Sensitive contents" > "$TEST_SCRAP_DIR/sensitive.txt"
+
+SENSITIVE_ASSET="$(DECENSOR_DIR="$ENCRYPTED_DIR" ./decensor add_and_tag "$TEST_SCRAP_DIR/sensitive.txt" sourcetag)" || fail "Should be able to add to the store before encrypting"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" ./decensor keygen || fail "Should be able to generate a key before encrypting"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" ./decensor sign || fail "Should be able to sign before encrypting"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" ./decensor replication_report || fail "Should be able to save a replication report before encrypting"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" DECENSOR_PASSPHRASE=correct ./decensor encrypt || fail "Should be able to encrypt the store"
+
+[ -f "$ENCRYPTED_DIR/encrypted/$SENSITIVE_ASSET" ] || fail "Asset should be encrypted"
+
+grep -r "Sensitive contents\|sensitive.txt\|sourcetag" "$ENCRYPTED_DIR" && fail "Contents, filenames and tags should not be in the clear"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" DECENSOR_PASSPHRASE=correct ./decensor sign && fail "Encrypted stores should not sign"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" DECENSOR_PASSPHRASE=correct ./decensor replication_report | grep "sensitive.txt" || fail "Replication report should show decrypted filenames"
+
+grep -r "Sensitive contents\|sensitive.txt\|sourcetag" "$ENCRYPTED_DIR" && fail "Manifests and replication reports should not have filenames and tags in the clear"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" DECENSOR_PASSPHRASE=wrong ./decensor tags && fail "Should not unlock with the wrong passphrase"
+
+echo correct | DECENSOR_DIR="$ENCRYPTED_DIR" ./decensor tags | grep "^sourcetag$" || fail "Should be able to read tags with the passphrase on stdin"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" DECENSOR_PASSPHRASE=correct ./decensor info "$SENSITIVE_ASSET" | grep "^Filename: sensitive.txt$" || fail "Should be able to read filenames"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" DECENSOR_PASSPHRASE=correct ./decensor validate_assets || fail "Encrypted assets should validate"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" ./decensor web :4997 &
+ENCRYPTED_PID=$!
+
+sleep 1
+
+curl -s --fail "http://localhost:4997/asset/$SENSITIVE_ASSET" && fail "Locked store should not serve assets"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" DECENSOR_PASSPHRASE=wrong ./decensor unlock && fail "Should not unlock web with the wrong passphrase"
+
+DECENSOR_DIR="$ENCRYPTED_DIR" DECENSOR_PASSPHRASE=correct ./decensor unlock || fail "Should be able to unlock web"
+
+curl -s --show-error --fail "http://localhost:4997/asset/$SENSITIVE_ASSET" | cmp - "$TEST_SCRAP_DIR/sensitive.txt" || fail "Unlocked store should serve decrypted assets"
+
+curl -s --show-error --fail "http://localhost:4997/tag/sourcetag" | grep "$SENSITIVE_ASSET" || fail "Unlocked store should list assets by tag"
+
 ##
 
 # All done
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Torrents are hybrid v1 (BEP 3) and v2 (BEP 52) with our own server as a
+// web seed (BEP 19). Everything is computed from the stored bytes.
+
+// v2 merkle tree leaves are always 16 KiB.
+const torrentBlockSize = 16 * 1024
+
+const torrentMinPieceLength = 256 * 1024
+const torrentMaxPieceLength = 16 * 1024 * 1024
+
+// Aim for no more than this many pieces, within the limits above.
+const torrentTargetPieces = 2000
+
+// Per asset hashes for one piece length. Because hybrid torrents pad every
+// file to a piece boundary, these don't depend on the other files.
+type torrentFileHashes struct {
+	Length int64
+	// v1 SHA1 of every full piece.
+	Pieces []byte
+	// v1 SHA1 of the last partial piece as is, and padded with zeros.
+	TailHash       []byte
+	TailPaddedHash []byte
+	// v2 merkle root and the layer of piece sized subtrees.
+	PiecesRoot []byte
+	PieceLayer []byte
+}
+
+var torrentHashCache = make(map[string]torrentFileHashes)
+var torrentHashCacheLock sync.Mutex
+
+func torrentPieceLength(totalLength int64) int64 {
+	pieceLength := int64(torrentMinPieceLength)
+	for totalLength/pieceLength > torrentTargetPieces && pieceLength < torrentMaxPieceLength {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+func nextPowerOfTwo(n int) int {
+	power := 1
+	for power < n {
+		power *= 2
+	}
+	return power
+}
+
+// Merkle root of nodes, padded out to width with padNode.
+func merkleRoot(nodes [][]byte, padNode []byte, width int) []byte {
+	layer := make([][]byte, width)
+	copy(layer, nodes)
+	for index := len(nodes); index < width; index++ {
+		layer[index] = padNode
+	}
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for index := range next {
+			hash := sha256.New()
+			hash.Write(layer[index*2])
+			hash.Write(layer[index*2+1])
+			next[index] = hash.Sum(nil)
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+func hashTorrentFile(reader io.Reader, pieceLength int64) (hashes torrentFileHashes, err error) {
+	blocksPerPiece := int(pieceLength / torrentBlockSize)
+	zeroLeaf := make([]byte, sha256.Size)
+	var leaves [][]byte
+	var pieceNodes [][]byte
+	piece := make([]byte, pieceLength)
+	for {
+		var n int
+		n, err = io.ReadFull(reader, piece)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return
+		}
+		err = nil
+		hashes.Length += int64(n)
+		data := piece[:n]
+		if int64(n) == pieceLength {
+			pieceHash := sha1.Sum(data)
+			hashes.Pieces = append(hashes.Pieces, pieceHash[:]...)
+		} else {
+			tailHash := sha1.Sum(data)
+			hashes.TailHash = tailHash[:]
+			// The rest of piece is still whatever we read before, zero it.
+			padded := piece[:pieceLength]
+			for index := n; index < len(padded); index++ {
+				padded[index] = 0
+			}
+			tailPaddedHash := sha1.Sum(padded)
+			hashes.TailPaddedHash = tailPaddedHash[:]
+		}
+		var pieceLeaves [][]byte
+		for offset := 0; offset < n; offset += torrentBlockSize {
+			end := offset + torrentBlockSize
+			if end > n {
+				end = n
+			}
+			leaf := sha256.Sum256(data[offset:end])
+			pieceLeaves = append(pieceLeaves, leaf[:])
+		}
+		leaves = append(leaves, pieceLeaves...)
+		pieceNodes = append(pieceNodes, merkleRoot(pieceLeaves, zeroLeaf, blocksPerPiece))
+		if int64(n) < pieceLength {
+			break
+		}
+	}
+	if hashes.Length == 0 {
+		// Empty files have no pieces root.
+		return
+	}
+	if hashes.Length <= pieceLength {
+		hashes.PiecesRoot = merkleRoot(leaves, zeroLeaf, nextPowerOfTwo(len(leaves)))
+		return
+	}
+	for _, node := range pieceNodes {
+		hashes.PieceLayer = append(hashes.PieceLayer, node...)
+	}
+	padNode := merkleRoot(nil, zeroLeaf, blocksPerPiece)
+	hashes.PiecesRoot = merkleRoot(pieceNodes, padNode, nextPowerOfTwo(len(pieceNodes)))
+	return
+}
+
+func hashAssetForTorrent(asset string, pieceLength int64) (hashes torrentFileHashes, err error) {
+	fd, err := openAsset(asset)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	return hashTorrentFile(fd, pieceLength)
+}
+
+func writeTorrentHashesCache(asset string, path string, hashes torrentFileHashes) {
+	encoded, err := json.Marshal(hashes)
+	if err == nil {
+		if err = init_metadata(asset); err == nil {
+			err = ioutil.WriteFile(path, encoded, 0644)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to cache torrent hashes for %s: %s", asset, err.Error())
+	}
+}
+
+func getAssetFilePathTorrentHashes(asset string, pieceLength int64) string {
+	return metadataDir() + "/" + asset + "/torrent_" + strconv.FormatInt(pieceLength, 10)
+}
+
+// Hashed when an asset is added, so web mode doesn't have to.
+func addTorrentHashes(asset string) (err error) {
+	size, err := getAssetSize(asset)
+	if err != nil {
+		return
+	}
+	pieceLength := torrentPieceLength(size)
+	hashes, err := hashAssetForTorrent(asset, pieceLength)
+	if err != nil {
+		return
+	}
+	encoded, err := json.Marshal(hashes)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(getAssetFilePathTorrentHashes(asset, pieceLength), encoded, 0644)
+}
+
+// Whether assetTorrent() can be built without hashing the asset.
+func assetTorrentCached(asset string) bool {
+	size, err := getAssetSize(asset)
+	if err != nil {
+		return false
+	}
+	pieceLength := torrentPieceLength(size)
+	torrentHashCacheLock.Lock()
+	_, ok := torrentHashCache[asset+"/"+strconv.FormatInt(pieceLength, 10)]
+	torrentHashCacheLock.Unlock()
+	if ok {
+		return true
+	}
+	_, err = os.Stat(getAssetFilePathTorrentHashes(asset, pieceLength))
+	return err == nil
+}
+
+// Hashing big assets is slow, so we cache the result in memory and, when we
+// can write to the store, in metadata. Assets added before torrents were
+// hashed on add are hashed here the first time someone asks.
+func getAssetTorrentHashes(asset string, pieceLength int64) (hashes torrentFileHashes, err error) {
+	cacheKey := asset + "/" + strconv.FormatInt(pieceLength, 10)
+	torrentHashCacheLock.Lock()
+	hashes, ok := torrentHashCache[cacheKey]
+	torrentHashCacheLock.Unlock()
+	if ok {
+		return
+	}
+	path := getAssetFilePathTorrentHashes(asset, pieceLength)
+	cached, err := ioutil.ReadFile(path)
+	if err != nil || json.Unmarshal(cached, &hashes) != nil {
+		if !hashOnDemand(asset) {
+			return hashes, errNotHashed
+		}
+		return hashTorrentHashes(asset, pieceLength)
+	}
+	torrentHashCacheLock.Lock()
+	torrentHashCache[cacheKey] = hashes
+	torrentHashCacheLock.Unlock()
+	return
+}
+
+// Hashes an asset for a torrent, recording it in metadata if we can and in memory.
+func hashTorrentHashes(asset string, pieceLength int64) (hashes torrentFileHashes, err error) {
+	if hashes, err = hashAssetForTorrent(asset, pieceLength); err != nil {
+		return
+	}
+	writeTorrentHashesCache(asset, getAssetFilePathTorrentHashes(asset, pieceLength), hashes)
+	torrentHashCacheLock.Lock()
+	torrentHashCache[asset+"/"+strconv.FormatInt(pieceLength, 10)] = hashes
+	torrentHashCacheLock.Unlock()
+	return
+}
+
+type torrent struct {
+	Name      string
+	Length    int64
+	Metainfo  []byte
+	InfoHash  string
+	InfoHash2 string
+	WebSeed   string
+}
+
+// Builds a hybrid torrent. A single asset is a single file torrent, anything
+// else is a directory named name. webSeed may be "".
+func makeTorrent(name string, assets []string, names []string, single bool, webSeed string) (t torrent, err error) {
+	t.Name = name
+	t.WebSeed = webSeed
+	for _, asset := range assets {
+		size, err := getAssetSize(asset)
+		if err != nil {
+			return t, err
+		}
+		t.Length += size
+	}
+	pieceLength := torrentPieceLength(t.Length)
+	// v1 file order has to match the sorted v2 file tree.
+	order := make([]int, len(assets))
+	for index := range order {
+		order[index] = index
+	}
+	sort.Slice(order, func(i, j int) bool { return names[order[i]] < names[order[j]] })
+
+	var pieces []byte
+	var files []interface{}
+	fileTree := make(map[string]interface{})
+	pieceLayers := make(map[string]interface{})
+	for position, index := range order {
+		hashes, err := getAssetTorrentHashes(assets[index], pieceLength)
+		if err != nil {
+			return t, err
+		}
+		last := position == len(order)-1
+		pieces = append(pieces, hashes.Pieces...)
+		if hashes.TailHash != nil {
+			if last {
+				pieces = append(pieces, hashes.TailHash...)
+			} else {
+				pieces = append(pieces, hashes.TailPaddedHash...)
+			}
+		}
+		fileInfo := map[string]interface{}{"length": hashes.Length}
+		if hashes.PiecesRoot != nil {
+			fileInfo["pieces root"] = hashes.PiecesRoot
+		}
+		if hashes.PieceLayer != nil {
+			pieceLayers[string(hashes.PiecesRoot)] = hashes.PieceLayer
+		}
+		fileTree[names[index]] = map[string]interface{}{"": fileInfo}
+		files = append(files, map[string]interface{}{"length": hashes.Length, "path": []interface{}{names[index]}})
+		if padding := (pieceLength - hashes.Length%pieceLength) % pieceLength; !last && padding != 0 {
+			files = append(files, map[string]interface{}{"attr": "p",
+				"length": padding,
+				"path":   []interface{}{".pad", strconv.FormatInt(padding, 10)}})
+		}
+	}
+	info := map[string]interface{}{"name": name,
+		"piece length": pieceLength,
+		"pieces":       pieces,
+		"meta version": 2}
+	// For a single file, the only file tree entry is name itself.
+	info["file tree"] = fileTree
+	if single {
+		info["length"] = t.Length
+	} else {
+		info["files"] = files
+	}
+	encodedInfo, err := bencodeBytes(info)
+	if err != nil {
+		return
+	}
+	infoHash := sha1.Sum(encodedInfo)
+	infoHash2 := sha256.Sum256(encodedInfo)
+	t.InfoHash = hex.EncodeToString(infoHash[:])
+	t.InfoHash2 = hex.EncodeToString(infoHash2[:])
+	metainfo := map[string]interface{}{"info": info,
+		"piece layers": pieceLayers,
+		"created by":   "decensor"}
+	if webSeed != "" {
+		metainfo["url-list"] = webSeed
+	}
+	t.Metainfo, err = bencodeBytes(metainfo)
+	return
+}
+
+func (t torrent) magnet() string {
+	values := url.Values{}
+	values.Set("dn", t.Name)
+	values.Set("xl", strconv.FormatInt(t.Length, 10))
+	if t.WebSeed != "" {
+		values.Set("ws", t.WebSeed)
+	}
+	// xt is repeated and has to stay unescaped to be read by most clients.
+	return fmt.Sprintf("magnet:?xt=urn:btih:%s&xt=urn:btmh:1220%s&%s", t.InfoHash, t.InfoHash2, values.Encode())
+}
+
+// root is the site URL ending in /, or "" for no web seed.
+func assetTorrent(asset string, root string) (t torrent, err error) {
+	if err = validateAsset(asset); err != nil {
+		return
+	}
+	names := archiveFilenames([]string{asset})
+	webSeed := ""
+	if root != "" {
+		webSeed = root + "asset/" + asset
+	}
+	return makeTorrent(names[0], []string{asset}, names, true, webSeed)
+}
+
+func tagTorrent(tag string, root string) (t torrent, err error) {
+	if has_dot(tag) {
+		err = errors.New("Tags with .'s can't be served as torrents.")
+		return
+	}
+	tag_assets, err := assets_by_tag(tag)
+	if err != nil {
+		return
+	}
+	if len(tag_assets) == 0 {
+		err = errors.New("Tag has no assets.")
+		return
+	}
+	webSeed := ""
+	if root != "" {
+		// Clients append <name>/<path>, see httpWebSeed().
+		webSeed = root + "webseed/"
+	}
+	return makeTorrent(tag, tag_assets, archiveFilenames(tag_assets), false, webSeed)
+}
+
+// Torrent for an asset if the argument is one we have, otherwise for a tag.
+func assetOrTagTorrent(assetOrTag string, root string) (torrent, error) {
+	if asset, err := resolveAsset(assetOrTag); err == nil {
+		if assetExists(asset) {
+			return assetTorrent(asset, root)
+		}
+	}
+	return tagTorrent(assetOrTag, root)
+}
+
+func httpTorrent(w http.ResponseWriter, r *http.Request, t torrent, err error) {
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "No such asset or tag found.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+t.Name+".torrent\"")
+	if _, err = w.Write(t.Metainfo); err != nil {
+		log.Print(err)
+	}
+}
+
+// /webseed/<tag>/<filename> serves tag torrents' files by name (BEP 19).
+func httpWebSeed(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/webseed/"), "/", 2)
+	if len(pathParts) == 2 && !has_dot(pathParts[0]) {
+		if tag_assets, err := assets_by_tag(pathParts[0]); err == nil {
+			for index, name := range archiveFilenames(tag_assets) {
+				if name == pathParts[1] {
+					httpServeAsset(w, r, tag_assets[index])
+					return
+				}
+			}
+		}
+	}
+	http.Error(w, "No such file in that tag.", http.StatusNotFound)
+}
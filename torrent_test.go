@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBencode(t *testing.T) {
+	encoded, err := bencodeBytes(map[string]interface{}{
+		"name":   "foo",
+		"length": int64(3),
+		"list":   []interface{}{1, []byte("ab")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "d6:lengthi3e4:listli1e2:abe4:name3:fooe"
+	if string(encoded) != expected {
+		t.Errorf("Expected %s, got %s", expected, encoded)
+	}
+	if _, err = bencodeBytes(1.5); err == nil {
+		t.Error("Floats can't be bencoded.")
+	}
+}
+
+func TestHashTorrentFile(t *testing.T) {
+	// One block: the pieces root is just the block's hash.
+	content := []byte("Hello World\n")
+	hashes, err := hashTorrentFile(bytes.NewReader(content), torrentMinPieceLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := sha256.Sum256(content)
+	if !bytes.Equal(hashes.PiecesRoot, leaf[:]) {
+		t.Error("Single block pieces root should be the block's SHA256.")
+	}
+	if hashes.Pieces != nil || hashes.TailHash == nil || hashes.PieceLayer != nil {
+		t.Error("Small files should only have a tail piece.")
+	}
+
+	// Two and a half pieces.
+	content = make([]byte, torrentMinPieceLength*5/2)
+	hashes, err = hashTorrentFile(bytes.NewReader(content), torrentMinPieceLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes.Pieces) != 2*20 || len(hashes.PieceLayer) != 3*32 {
+		t.Errorf("Unexpected piece counts: %d v1, %d v2", len(hashes.Pieces)/20, len(hashes.PieceLayer)/32)
+	}
+	if hashes.Length != int64(len(content)) {
+		t.Errorf("Expected length %d, got %d", len(content), hashes.Length)
+	}
+}
+
+func TestTorrentPieceLength(t *testing.T) {
+	if torrentPieceLength(0) != torrentMinPieceLength {
+		t.Error("Small torrents should use the minimum piece length.")
+	}
+	if torrentPieceLength(1<<40) != torrentMaxPieceLength {
+		t.Error("Huge torrents should use the maximum piece length.")
+	}
+}
+
+func TestAddTorrentHashes(t *testing.T) {
+	t.Setenv("DECENSOR_DIR", t.TempDir()+"/store")
+	if err := init_folders(); err != nil {
+		t.Fatal(err)
+	}
+	source := t.TempDir() + "/source"
+	if err := ioutil.WriteFile(source, []byte("torrent me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	asset, err := add(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assetTorrentCached(asset) {
+		t.Errorf("Adding an asset should hash it for its torrent")
+	}
+	if err = os.Remove(getAssetFilePathTorrentHashes(asset, torrentMinPieceLength)); err != nil {
+		t.Fatal(err)
+	}
+	if assetTorrentCached(asset) {
+		t.Errorf("Should not be cached without its torrent hashes")
+	}
+}
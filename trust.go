@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The keyring is one file per trusted publisher under trustedDir(), named by
+// the hex ed25519 public key and containing a name for people to read.
+// Assets record which publishers' manifests vouched for them under
+// metadata/<asset>/attested_by/<public key>, like back tags.
+
+func trustedDir() string {
+	return baseDir() + "/trusted"
+}
+
+func getTrustedPath(publicKey string) string {
+	return trustedDir() + "/" + publicKey
+}
+
+func getAssetFilePathAttestations(asset string) string {
+	return metadataDir() + "/" + asset + "/attested_by/"
+}
+
+func validatePublicKeyHex(publicKey string) error {
+	if len(publicKey) != ed25519.PublicKeySize*2 || !isHex(publicKey) {
+		return errors.New("Public keys must be 64 hex characters.")
+	}
+	return nil
+}
+
+func trust(publicKey string, name string) (err error) {
+	publicKey = strings.ToLower(publicKey)
+	if err = validatePublicKeyHex(publicKey); err != nil {
+		return
+	}
+	if name == "" || strings.Contains(name, "\n") {
+		return errors.New("Publisher names must be a single line.")
+	}
+	// Stores from before the keyring existed won't have the directory.
+	if err = os.MkdirAll(trustedDir(), 0755); err != nil {
+		return
+	}
+	return ioutil.WriteFile(getTrustedPath(publicKey), []byte(name+"\n"), 0644)
+}
+
+func untrust(publicKey string) (err error) {
+	publicKey = strings.ToLower(publicKey)
+	if err = validatePublicKeyHex(publicKey); err != nil {
+		return
+	}
+	if err = os.Remove(getTrustedPath(publicKey)); os.IsNotExist(err) {
+		err = errors.New("Publisher is not trusted.")
+	}
+	return
+}
+
+// Returns the publisher's name and whether we trust them.
+func getTrustedPublisher(publicKey string) (name string, trusted bool) {
+	if validatePublicKeyHex(publicKey) != nil {
+		return
+	}
+	nameByte, err := ioutil.ReadFile(getTrustedPath(publicKey))
+	if err != nil {
+		return
+	}
+	return strings.Trim(string(nameByte), "\n"), true
+}
+
+// Lists the keyring as "<public key> <name>".
+func trusted() (output []string, err error) {
+	publicKeys, err := list_directory(trustedDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	for _, publicKey := range publicKeys {
+		name, _ := getTrustedPublisher(publicKey)
+		output = append(output, publicKey+" "+name)
+	}
+	return
+}
+
+func attest(asset string, publicKey string) (err error) {
+	if err = init_metadata(asset); err != nil {
+		return
+	}
+	if err = os.MkdirAll(getAssetFilePathAttestations(asset), 0755); err != nil {
+		return
+	}
+	path := getAssetFilePathAttestations(asset) + publicKey
+	// Replication attests over and over, don't churn the store's mtimes.
+	if _, err = os.Stat(path); err == nil {
+		return
+	}
+	if err = ioutil.WriteFile(path, []byte(""), 0644); err != nil {
+		return
+	}
+	return journalMetadata(asset, "attested_by", publicKey)
+}
+
+func attestations_by_asset(asset string) (publicKeys []string) {
+	// Most assets were added locally and have no attestations.
+	publicKeys, _ = list_directory(getAssetFilePathAttestations(asset))
+	return
+}
+
+// Readable publisher names for an asset, for info and the web UI.
+func publishers_by_asset(asset string) (publishers []string) {
+	for _, publicKey := range attestations_by_asset(asset) {
+		// Stray files, like a leftover .tmp, aren't attestations.
+		if validatePublicKeyHex(publicKey) != nil {
+			continue
+		}
+		if name, trusted := getTrustedPublisher(publicKey); trusted {
+			publishers = append(publishers, name+" ("+publicKey[:16]+")")
+		} else {
+			publishers = append(publishers, publicKey[:16]+" (untrusted)")
+		}
+	}
+	return
+}
+
+// The publisher a manifest claims to be from. The signature still has to be
+// checked against it.
+func manifestPublicKey(contents signedManifest) (publicKey string, err error) {
+	publicKey = strings.ToLower(contents.PublicKey)
+	err = validatePublicKeyHex(publicKey)
+	return
+}
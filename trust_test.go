@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestValidateTagName(t *testing.T) {
+	for _, tag := range []string{"foo", "censoredtopic_1", "foo bar"} {
+		if err := validateTagName(tag); err != nil {
+			t.Errorf("%s should be a valid tag: %s", tag, err.Error())
+		}
+	}
+	for _, tag := range []string{"", ".", "..", "../../etc", "foo/bar", ".hidden"} {
+		if err := validateTagName(tag); err == nil {
+			t.Errorf("%s should not be a valid tag", tag)
+		}
+	}
+}
+
+func TestMirrorManifestURL(t *testing.T) {
+	for _, source := range []string{"https://example.com/", "https://example.com", "https://example.com/manifest"} {
+		manifestURL, root := mirrorManifestURL(source)
+		if manifestURL != "https://example.com/manifest" || root != "https://example.com/" {
+			t.Errorf("Wrong URLs for %s: %s %s", source, manifestURL, root)
+		}
+	}
+}
+
+func TestPublishersByAssetSkipsStrayFiles(t *testing.T) {
+	t.Setenv("DECENSOR_DIR", t.TempDir()+"/store")
+	if err := init_folders(); err != nil {
+		t.Fatal(err)
+	}
+	asset := "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26"
+	publicKey := "3b6a27bcceb6a42d62a3a8d02a6f0d73653215771de243a63ac048a18b59da29"
+	if err := os.MkdirAll(getAssetFilePathAttestations(asset), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{publicKey, "short", publicKey + ".tmp"} {
+		if err := ioutil.WriteFile(getAssetFilePathAttestations(asset)+"/"+name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publishers := publishers_by_asset(asset)
+	if len(publishers) != 1 || publishers[0] != publicKey[:16]+" (untrusted)" {
+		t.Errorf("Expected only the real attestation, got %v", publishers)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads for files too big to get through in one go. A client
+// creates a session, PUTs chunks at the offset the session is at, asks for
+// the offset again if a chunk fails, and finalizes with the SHA256 it
+// expects. Sessions are a directory under uploadsDir() with the data so
+// far and one file per value, like metadata. Sessions nobody has touched
+// for uploadExpiry are deleted.
+//
+// Uploads use the push token, see push.go.
+
+const uploadExpiry = 24 * time.Hour
+
+// How much the upload command sends per PUT.
+const uploadChunkSize = 8 * 1024 * 1024
+
+type uploadStatus struct {
+	ID       string    `json:"id"`
+	Filename string    `json:"filename"`
+	Size     int64     `json:"size"`
+	Offset   int64     `json:"offset"`
+	Expires  time.Time `json:"expires"`
+	// Only set once finalized.
+	Asset string `json:"asset,omitempty"`
+}
+
+func uploadsDir() string {
+	return baseDir() + "/uploads"
+}
+
+func getUploadPath(id string) string {
+	return uploadsDir() + "/" + id
+}
+
+func validateUploadID(id string) error {
+	if len(id) != 32 || !isHex(id) {
+		return errors.New("Upload IDs are 32 hex characters.")
+	}
+	return nil
+}
+
+func getUploadValue(id string, name string) string {
+	valueByte, err := ioutil.ReadFile(getUploadPath(id) + "/" + name)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(string(valueByte), "\n")
+}
+
+func createUpload(filename string, size int64, upload_tags []string) (status uploadStatus, err error) {
+	if filename == "" || size < 0 {
+		err = errors.New("Uploads need a filename and a size.")
+		return
+	}
+	for _, tag := range upload_tags {
+		if err = validateTagName(tag); err != nil {
+			return
+		}
+	}
+	// A good time to clear out abandoned sessions.
+	if expireErr := expireUploads(); expireErr != nil {
+		log.Print(expireErr)
+	}
+	random := make([]byte, 16)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	id := hex.EncodeToString(random)
+	// Stores from before uploads existed won't have the directory.
+	if err = os.MkdirAll(getUploadPath(id), 0755); err != nil {
+		return
+	}
+	values := map[string]string{"filename": filepath.Base(filename),
+		"size": strconv.FormatInt(size, 10),
+		"tags": strings.Join(upload_tags, "\n")}
+	for name, value := range values {
+		if err = ioutil.WriteFile(getUploadPath(id)+"/"+name, []byte(value+"\n"), 0644); err != nil {
+			return
+		}
+	}
+	if err = ioutil.WriteFile(getUploadPath(id)+"/data", []byte(""), 0644); err != nil {
+		return
+	}
+	return getUpload(id)
+}
+
+func getUpload(id string) (status uploadStatus, err error) {
+	if err = validateUploadID(id); err != nil {
+		return
+	}
+	stat, err := os.Stat(getUploadPath(id) + "/data")
+	if os.IsNotExist(err) {
+		err = errors.New("No such upload.")
+		return
+	}
+	if err != nil {
+		return
+	}
+	status = uploadStatus{ID: id,
+		Filename: getUploadValue(id, "filename"),
+		Offset:   stat.Size(),
+		Expires:  stat.ModTime().Add(uploadExpiry).UTC()}
+	status.Size, err = strconv.ParseInt(getUploadValue(id, "size"), 10, 64)
+	return
+}
+
+// Appends a chunk, which has to start where the upload is at.
+func writeUploadChunk(id string, offset int64, chunk io.Reader) (status uploadStatus, err error) {
+	if status, err = getUpload(id); err != nil {
+		return
+	}
+	fd, err := openPartial(getUploadPath(id)+"/data", 0)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	// Where it's at now that nothing else can add to it.
+	status.Offset = partialOffset(fd)
+	if offset != status.Offset {
+		err = fmt.Errorf("Upload is at %d bytes, not %d.", status.Offset, offset)
+		return
+	}
+	// Whatever arrives before the client goes away is kept.
+	received, err := io.Copy(fd, io.LimitReader(chunk, status.Size-offset+1))
+	status.Offset += received
+	if err == nil && status.Offset > status.Size {
+		// Drop the whole chunk, the client is confused.
+		err = fd.Truncate(offset)
+		status.Offset = offset
+		if err == nil {
+			err = errors.New("Chunk goes past the end of the upload.")
+		}
+	}
+	return
+}
+
+// Checks a complete upload against the SHA256 the client expects and moves
+// it into the store.
+func finalizeUpload(id string, sha256 string) (status uploadStatus, err error) {
+	if status, err = getUpload(id); err != nil {
+		return
+	}
+	path := getUploadPath(id) + "/data"
+	// Held until the session is gone, so no chunk lands while we hash it.
+	fd, err := openPartial(path, 0)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	status.Offset = partialOffset(fd)
+	if status.Offset != status.Size {
+		err = fmt.Errorf("Upload is incomplete, %d of %d bytes.", status.Offset, status.Size)
+		return
+	}
+	sha256Algorithm, err := getHashAlgorithm("sha2-256")
+	if err != nil {
+		return
+	}
+	// Legacy assets are named by their SHA256 in hex.
+	actual, err := hashFile(path, sha256Algorithm)
+	if err != nil {
+		return
+	}
+	if actual != strings.ToLower(sha256) {
+		// It's not coming right by uploading more, start over.
+		err = fmt.Errorf("SHA256 is %s, not %s.", actual, sha256)
+		os.RemoveAll(getUploadPath(id))
+		return
+	}
+	algorithm, err := storeHashAlgorithm()
+	if err != nil {
+		return
+	}
+	asset := actual
+	if algorithm.name != sha256Algorithm.name {
+		if asset, err = hashFile(path, algorithm); err != nil {
+			return
+		}
+	}
+	if !assetExists(asset) {
+		if err = storeAssetFile(asset, path); err != nil {
+			return
+		}
+		if err = addAssetMetadata(asset, status.Filename); err != nil {
+			return
+		}
+	}
+	var upload_tags []string
+	if tags := getUploadValue(id, "tags"); tags != "" {
+		upload_tags = strings.Split(tags, "\n")
+	}
+	if err = tagMissing(asset, upload_tags); err != nil {
+		return
+	}
+	status.Asset = asset
+	err = os.RemoveAll(getUploadPath(id))
+	return
+}
+
+func abortUpload(id string) (err error) {
+	if _, err = getUpload(id); err != nil {
+		return
+	}
+	fd, err := openPartial(getUploadPath(id)+"/data", 0)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	return os.RemoveAll(getUploadPath(id))
+}
+
+// Deletes sessions nobody has written to for uploadExpiry.
+func expireUploads() (err error) {
+	ids, err := list_directory(uploadsDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		// Sessions being created don't have data yet, go by the directory.
+		stat, statErr := os.Stat(getUploadPath(id) + "/data")
+		if os.IsNotExist(statErr) {
+			stat, statErr = os.Stat(getUploadPath(id))
+		}
+		if statErr == nil && time.Since(stat.ModTime()) < uploadExpiry {
+			continue
+		}
+		// Something is still writing to it.
+		fd, lockErr := openPartial(getUploadPath(id)+"/data", 0)
+		if lockErr == errPartialBusy {
+			continue
+		}
+		log.Printf("Expiring upload %s.", id)
+		err = os.RemoveAll(getUploadPath(id))
+		if fd != nil {
+			fd.Close()
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Partial pushes in incoming/ expire here too.
+func expireUploadsLoop() {
+	for {
+		if err := expireUploads(); err != nil {
+			log.Print(err)
+		}
+		if err := expireIncoming(); err != nil {
+			log.Print(err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func writeUploadStatus(w http.ResponseWriter, code int, status uploadStatus) {
+	output, err := json.Marshal(status)
+	if err != nil {
+		httpHandle500(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if _, err = w.Write(append(output, '\n')); err != nil {
+		log.Print(err)
+	}
+}
+
+// POST   /upload?filename=<filename>&size=<bytes>&tag=<tag>...  creates a session.
+// GET    /upload/<id>                                           says how far along it is.
+// PUT    /upload/<id>?offset=<bytes>                            appends a chunk.
+// POST   /upload/<id>/finalize?sha256=<hex>                     stores the asset.
+// DELETE /upload/<id>                                           gives up.
+func httpUpload(w http.ResponseWriter, r *http.Request) {
+	if err := checkPushToken(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathParts) == 1 {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST to create an upload.", http.StatusMethodNotAllowed)
+			return
+		}
+		size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+		if err != nil {
+			httpHandle400(w, errors.New("size must be a byte count."))
+			return
+		}
+		status, err := createUpload(query.Get("filename"), size, query["tag"])
+		if err != nil {
+			httpHandle400(w, err)
+			return
+		}
+		writeUploadStatus(w, http.StatusCreated, status)
+		return
+	}
+	id := pathParts[1]
+	if err := validateUploadID(id); err != nil {
+		httpHandle400(w, err)
+		return
+	}
+	if len(pathParts) == 3 && pathParts[2] == "finalize" && r.Method == http.MethodPost {
+		status, err := finalizeUpload(id, query.Get("sha256"))
+		if err == errPartialBusy {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			httpHandle400(w, err)
+			return
+		}
+		writeUploadStatus(w, http.StatusCreated, status)
+		return
+	}
+	if len(pathParts) != 2 {
+		http.Error(w, "Decensor endpoint does not exist.", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		status, err := getUpload(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeUploadStatus(w, http.StatusOK, status)
+	case http.MethodPut:
+		offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+		if err != nil {
+			httpHandle400(w, errors.New("offset must be a byte count."))
+			return
+		}
+		status, err := writeUploadChunk(id, offset, r.Body)
+		if err != nil {
+			log.Printf("Upload %s: %s", id, err.Error())
+			// The client can GET the upload to see where to carry on from.
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeUploadStatus(w, http.StatusOK, status)
+	case http.MethodDelete:
+		if err := abortUpload(id); err == errPartialBusy {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "GET, PUT or DELETE an upload.", http.StatusMethodNotAllowed)
+	}
+}
+
+func uploadRequest(method string, requestURL string, token string, body io.Reader, contentLength int64) (status uploadStatus, err error) {
+	response, err := pushRequest(method, requestURL, token, body, contentLength)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		err = fmt.Errorf("%s returned %s: %s", requestURL, response.Status, strings.TrimSpace(string(message)))
+		return
+	}
+	err = json.NewDecoder(io.LimitReader(response.Body, 1024*1024)).Decode(&status)
+	return
+}
+
+// Uploads a file in chunks, carrying on from wherever the remote says it
+// got to when a chunk fails.
+func upload(remote string, path string, upload_tags []string) (asset string, err error) {
+	if !isURL(remote) {
+		err = errors.New("Remotes must be http or https URLs.")
+		return
+	}
+	root := strings.TrimSuffix(remote, "/") + "/"
+	token := os.Getenv(pushTokenEnvironment)
+	if token == "" {
+		err = errors.New("Set " + pushTokenEnvironment + " to the remote's push token.")
+		return
+	}
+	sha256Algorithm, err := getHashAlgorithm("sha2-256")
+	if err != nil {
+		return
+	}
+	sha256, err := hashFile(path, sha256Algorithm)
+	if err != nil {
+		return
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	stat, err := fd.Stat()
+	if err != nil {
+		return
+	}
+	query := url.Values{"filename": {filepath.Base(path)},
+		"size": {strconv.FormatInt(stat.Size(), 10)},
+		"tag":  upload_tags}
+	status, err := uploadRequest(http.MethodPost, root+"upload?"+query.Encode(), token, nil, 0)
+	if err != nil {
+		return
+	}
+	sessionURL := root + "upload/" + status.ID
+	offset := status.Offset
+	failures := 0
+	for offset < stat.Size() {
+		length := stat.Size() - offset
+		if length > uploadChunkSize {
+			length = uploadChunkSize
+		}
+		chunk := io.NewSectionReader(fd, offset, length)
+		status, err = uploadRequest(http.MethodPut, sessionURL+"?offset="+strconv.FormatInt(offset, 10), token, chunk, length)
+		if err == nil {
+			offset = status.Offset
+			failures = 0
+			continue
+		}
+		if failures++; failures > pushAttempts {
+			return
+		}
+		log.Printf("%s, resuming.", err.Error())
+		if status, err = uploadRequest(http.MethodGet, sessionURL, token, nil, 0); err == nil {
+			offset = status.Offset
+		}
+	}
+	status, err = uploadRequest(http.MethodPost, sessionURL+"/finalize?sha256="+sha256, token, nil, 0)
+	asset = status.Asset
+	return
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateUploadID(t *testing.T) {
+	if err := validateUploadID("0123456789abcdef0123456789abcdef"); err != nil {
+		t.Errorf("Upload ID should be valid: %s", err.Error())
+	}
+	for _, id := range []string{"", "0123456789abcdef", "0123456789abcdef0123456789abcdeg", "../../../../../../../../etc/passwd"} {
+		if validateUploadID(id) == nil {
+			t.Errorf("%s should not be a valid upload ID", id)
+		}
+	}
+}
+
+func TestWriteUploadChunkWhileBusy(t *testing.T) {
+	t.Setenv("DECENSOR_DIR", t.TempDir()+"/store")
+	if err := init_folders(); err != nil {
+		t.Fatal(err)
+	}
+	status, err := createUpload("hello", 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like another PUT still writing its chunk.
+	fd, err := openPartial(getUploadPath(status.ID)+"/data", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writeUploadChunk(status.ID, 0, strings.NewReader("hello")); err != errPartialBusy {
+		t.Errorf("Expected errPartialBusy, got %v", err)
+	}
+	if _, err = finalizeUpload(status.ID, ""); err != errPartialBusy {
+		t.Errorf("Expected errPartialBusy finalizing, got %v", err)
+	}
+	if err = abortUpload(status.ID); err != errPartialBusy {
+		t.Errorf("Expected errPartialBusy aborting, got %v", err)
+	}
+	fd.Close()
+	if status, err = writeUploadChunk(status.ID, 0, strings.NewReader("hello")); err != nil || status.Offset != 5 {
+		t.Errorf("Expected to be at 5, got %d %v", status.Offset, err)
+	}
+	if _, err = writeUploadChunk(status.ID, 0, strings.NewReader("hello")); err == nil {
+		t.Errorf("A chunk at the wrong offset should fail")
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	t.Setenv("DECENSOR_DIR", t.TempDir()+"/store")
+	if err := init_folders(); err != nil {
+		t.Fatal(err)
+	}
+	// Sessions still being created don't have data yet.
+	creating := "0123456789abcdef0123456789abcdef"
+	abandoned := "fedcba9876543210fedcba9876543210"
+	for _, id := range []string{creating, abandoned} {
+		if err := os.MkdirAll(getUploadPath(id), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-uploadExpiry - time.Hour)
+	if err := os.Chtimes(getUploadPath(abandoned), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := expireUploads(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(getUploadPath(creating)); err != nil {
+		t.Errorf("A session being created should not expire: %v", err)
+	}
+	if _, err := os.Stat(getUploadPath(abandoned)); !os.IsNotExist(err) {
+		t.Errorf("An abandoned session should expire: %v", err)
+	}
+}
@@ -4,6 +4,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
 	"mime"
@@ -11,14 +12,10 @@ import (
 	"os"
 	"strings"
 	"syscall"
-	"text/template"
 
 	"gopkg.in/alexcesaro/statsd.v2"
 )
 
-const bootstrapCSSAsset = "60b19e5da6a9234ff9220668a5ec1125c157a268513256188ee80f2d2c8d8d36"
-const licenseAsset = "88d9b4eb60579c191ec391ca04c16130572d7eedc4a86daa58bf28c6e14c9bcd"
-
 func has_dot(some_string string) bool {
 	for _, character := range some_string {
 		if character == '.' {
@@ -28,9 +25,12 @@ func has_dot(some_string string) bool {
 	return false
 }
 
-func assetHTML(asset string, filename string, tags []string, activeTag string) (output string, err error) {
+func assetHTML(asset string, filename string, tags []string, activeTag string, linkPrefix string) (output string, err error) {
 	var size int64
 	var mimeType string
+	var cid string
+	var publishers []string
+	checksums := make(map[string]string)
 	// This is a performance optimization, maybe not ideal.
 	if activeTag == "permalink" {
 		size, err = getAssetSize(asset)
@@ -38,18 +38,36 @@ func assetHTML(asset string, filename string, tags []string, activeTag string) (
 			return
 		}
 		mimeType = getAssetMimeType(asset)
+		// Left out until web mode has hashed the asset.
+		if cid, err = getAssetCID(asset); err != nil && err != errNotHashed {
+			return
+		}
+		publishers = publishers_by_asset(asset)
+		for _, algorithm := range secondaryHashes {
+			if checksums[algorithm.name], err = getAssetChecksum(asset, algorithm.name); err != nil && err != errNotHashed {
+				return
+			}
+		}
+		err = nil
 	}
-	tmpl, err := template.New("").Parse(assetHTMLTemplate)
+	tmpl, err := template.New("").Parse(getTemplate("asset.html"))
 	if err != nil {
 		return
 	}
 	var renderedTemplate bytes.Buffer
-	templateArgs := assetHTMLTemplateArgs{Asset: asset,
-		Filename:  filename,
-		Tags:      tags,
-		ActiveTag: activeTag,
-		Size:      size,
-		MimeType:  mimeType}
+	templateArgs := assetHTMLTemplateArgs{LinkPrefix: linkPrefix,
+		Asset:      asset,
+		Filename:   filename,
+		Tags:       tags,
+		ActiveTag:  activeTag,
+		Size:       size,
+		MimeType:   mimeType,
+		CID:        cid,
+		Multihash:  assetMultihashString(asset),
+		SHA256:     checksums["sha256"],
+		SHA1:       checksums["sha1"],
+		MD5:        checksums["md5"],
+		Publishers: publishers}
 	if err = tmpl.Execute(&renderedTemplate, templateArgs); err != nil {
 		return
 	}
@@ -58,28 +76,33 @@ func assetHTML(asset string, filename string, tags []string, activeTag string) (
 }
 
 func assetListHTML(assets []string, activeTag string) (formatted_assets string, err error) {
+	return assetListHTMLOffset(assets, activeTag, 1)
+}
+
+func assetListHTMLOffset(assets []string, activeTag string, link_negative_offset int) (formatted_assets string, err error) {
 	// Set activeTag to "" if you don't want any tags highlighted.
 	var filename string
 	var tags []string
 	var html string
-	formatted_assets, err = headHTML(1)
+	linkPrefix := linkOffset(link_negative_offset)
+	formatted_assets, err = headHTML(link_negative_offset)
 	if err != nil {
 		return
 	}
 	for _, asset := range assets {
 		filename = getAssetFilename(asset)
 		tags = tags_by_asset(asset)
-		html, err = assetHTML(asset, filename, tags, activeTag)
+		html, err = assetHTML(asset, filename, tags, activeTag, linkPrefix)
 		if err != nil {
 			return
 		}
 		formatted_assets += html
 	}
-	formatted_assets += footerHTML
+	formatted_assets += footerHTML()
 	return
 }
 
-func infoHTML(asset string) (output string, err error) {
+func infoHTML(asset string, root string) (output string, err error) {
 	filename := getAssetFilename(asset)
 	tags := tags_by_asset(asset)
 	output, err = headHTML(1)
@@ -89,18 +112,36 @@ func infoHTML(asset string) (output string, err error) {
 
 	mimeType := getAssetMimeType(asset)
 	if strings.HasPrefix(mimeType, "image/") {
-		output += fmt.Sprintf("<img class=\"img-fluid\" src=\"../asset/%s\"/ alt=\"%s\">", asset, filename)
+		output += fmt.Sprintf("<img class=\"img-fluid\" src=\"../asset/%s\"/ alt=\"%s\">", asset, template.HTMLEscapeString(filename))
 	} else if strings.HasPrefix(mimeType, "video/") {
 		output += fmt.Sprintf("<video controls class=\"img-fluid\"><source src=\"../asset/%s\" /></video>", asset)
 	} else if strings.HasPrefix(mimeType, "audio/") {
 		output += fmt.Sprintf("<audio controls><source src=\"../asset/%s\" /><a target=\"blank\" href=\"../asset/%s\">Download</a></audio>", asset, asset)
+	} else if isTextualMimeType(mimeType) {
+		var preview string
+		preview, err = textPreviewHTML(asset, mimeType)
+		if err != nil {
+			return
+		}
+		output += preview
 	}
-	html, err := assetHTML(asset, filename, tags, "permalink")
+	html, err := assetHTML(asset, filename, tags, "permalink", linkOffset(1))
 	if err != err {
 		return
 	}
 	output += html
-	output += footerHTML
+	// The .torrent is built when it's asked for. The magnet link needs its
+	// info hash, so it's only shown if that's quick to work out.
+	magnet := ""
+	if assetTorrentCached(asset) {
+		if t, err := assetTorrent(asset, root); err != nil {
+			log.Print(err)
+		} else {
+			magnet = fmt.Sprintf(" <a href=\"%s\">Magnet link</a>", template.HTMLEscapeString(t.magnet()))
+		}
+	}
+	output += fmt.Sprintf("<div class=\"small mt-2\">BitTorrent: <a href=\"../torrent/%s\">.torrent</a>%s</div>", asset, magnet)
+	output += footerHTML()
 	return
 }
 
@@ -134,7 +175,7 @@ func countAssets() (count int, err error) {
 
 func headHTML(link_negative_offset int) (headHTML string, err error) {
 	linkPrefix := linkOffset(link_negative_offset)
-	tmpl, err := template.New("").Parse(headHTMLTemplate)
+	tmpl, err := template.New("").Parse(getTemplate("head.html"))
 	if err != nil {
 		return
 	}
@@ -148,9 +189,11 @@ func headHTML(link_negative_offset int) (headHTML string, err error) {
 	}
 	var renderedTemplate bytes.Buffer
 	templateArgs := headHTMLTemplateArgs{LinkPrefix: linkPrefix,
-		CSSAsset:   bootstrapCSSAsset,
-		AssetCount: assetCount,
-		TagCount:   tagCount}
+		CSSPath:         themeCSSURL(),
+		SiteTitle:       getSettingOrDefault("site_title"),
+		SiteDescription: getSettingOrDefault("site_description"),
+		AssetCount:      assetCount,
+		TagCount:        tagCount}
 	if err = tmpl.Execute(&renderedTemplate, templateArgs); err != nil {
 		return
 	}
@@ -158,19 +201,40 @@ func headHTML(link_negative_offset int) (headHTML string, err error) {
 	return
 }
 
+func footerHTML() string {
+	// Templates are checked when loaded, so errors here are unlikely and
+	// not worth failing the whole page over.
+	tmpl, err := template.New("").Parse(getTemplate("footer.html"))
+	if err != nil {
+		log.Print(err)
+		return footerHTMLTemplate
+	}
+	var renderedTemplate bytes.Buffer
+	templateArgs := footerHTMLTemplateArgs{SiteTitle: getSettingOrDefault("site_title"),
+		SourceURL: getSettingOrDefault("source_url")}
+	if err = tmpl.Execute(&renderedTemplate, templateArgs); err != nil {
+		log.Print(err)
+		return footerHTMLTemplate
+	}
+	return renderedTemplate.String()
+}
+
 func indexHTML() (output string, err error) {
 	head, err := headHTML(0)
 	if err != nil {
 		return
 	}
-	tmpl, err := template.New("").Parse(indexHTMLTemplate)
+	tmpl, err := template.New("").Parse(getTemplate("index.html"))
 	if err != nil {
 		return
 	}
 	var renderedTemplate bytes.Buffer
-	templateArgs := indexHTMLTemplateArgs{Head: head,
-		Footer:       footerHTML,
-		LicenseAsset: licenseAsset}
+	templateArgs := indexHTMLTemplateArgs{Head: template.HTML(head),
+		Footer:          template.HTML(footerHTML()),
+		SiteTitle:       getSettingOrDefault("site_title"),
+		SiteDescription: getSettingOrDefault("site_description"),
+		SourceURL:       getSettingOrDefault("source_url"),
+		LicensePath:     staticURL("LICENSE")}
 	if err = tmpl.Execute(&renderedTemplate, templateArgs); err != nil {
 		return
 	}
@@ -178,9 +242,25 @@ func indexHTML() (output string, err error) {
 	return
 }
 
-func web(port string) {
+func web(port string, templateDirectory string) {
 	var err error
 
+	if templateDirectory != "" {
+		if err = loadTemplates(templateDirectory); err != nil {
+			log.Fatal("Unable to load templates from ", templateDirectory, ": ", err.Error())
+		}
+	}
+
+	// Encrypted stores start locked. decensor unlock sends the passphrase
+	// over a socket we make before we chroot() and drop privileges.
+	if storeEncrypted() {
+		promptForPassphrase = false
+		if err = listenForUnlock(); err != nil {
+			log.Fatal("Unable to listen for decensor unlock: ", err.Error())
+		}
+		log.Print("Store is encrypted and locked, run decensor unlock.")
+	}
+
 	/* Golang on Linux does not support setUid/setGid: https://github.com/golang/go/issues/1435 */
 	/* chroot() without setuid() can be escaped and is mostly useless.                          */
 	/* Non-Linux systems like FreeBSD are fine, however.                                        */
@@ -192,6 +272,13 @@ func web(port string) {
 		/* subset of mime types to work with. We don't get .mp3 and .mp4, for example.    */
 		mime.TypeByExtension("")
 
+		/* Same for sniffed mime types, we can't write them to metadata as nobody. */
+		if storeLocked() {
+			log.Print("Store is locked, mime types will be sniffed as assets are requested.")
+		} else if _, err = getMimeTypes(); err != nil {
+			log.Print("Unable to prime sniffed mime types: ", err.Error())
+		}
+
 		dir := baseDir()
 		if err = syscall.Chroot(dir); err != nil {
 			log.Fatal("We are root but unable to chroot() to ", dir, ": ", err.Error())
@@ -217,6 +304,15 @@ func web(port string) {
 		log.Print("We are not root, unable to chroot().")
 	}
 
+	/* Hash anything that isn't yet in the background while we serve. After    */
+	/* chroot() we can't record them, so they're kept in memory. Locked stores */
+	/* are hashed once they're unlocked.                                       */
+	if !storeLocked() {
+		if err = startPrimingAssetHashes(); err != nil {
+			log.Print("Unable to prime asset hashes: ", err.Error())
+		}
+	}
+
 	/* Statsd statistics. This works fine with or without. */
 	s, err := statsd.New(statsd.Prefix("decensor"))
 	if err != nil {
@@ -231,25 +327,45 @@ func web(port string) {
 		s.Increment("asset.hit")
 		defer s.NewTiming().Send("asset")
 		pathParts := strings.Split(r.URL.Path, "/")
-		asset := pathParts[len(pathParts)-1]
-		err = validateAsset(asset)
+		// Legacy hex, hex multihash and base58 multihash all work.
+		asset, err := resolveAsset(pathParts[len(pathParts)-1])
 		if err != nil {
 			log.Print(err.Error())
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if mimeType := getAssetMimeType(asset); mimeType != "" {
-			w.Header().Set("Content-Type", mimeType)
-		}
-		if filename := getAssetFilename(asset); filename != asset {
-			w.Header().Set("Content-Disposition", "inline; filename=\""+filename+"\"")
+		httpServeAsset(w, r, asset)
+	})
+
+	http.HandleFunc("/recipe/", func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("recipe.hit")
+		defer s.NewTiming().Send("recipe")
+		asset, err := resolveAsset(strings.TrimPrefix(r.URL.Path, "/recipe/"))
+		if err != nil {
+			httpHandle400(w, err)
+			return
 		}
-		http.ServeFile(w, r, getAssetPath(asset))
+		httpRecipe(w, r, asset)
+	})
+
+	http.HandleFunc("/chunk/", func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("chunk.hit")
+		defer s.NewTiming().Send("chunk")
+		httpChunk(w, r, strings.TrimPrefix(r.URL.Path, "/chunk/"))
+	})
+
+	http.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("static.hit")
+		defer s.NewTiming().Send("static")
+		httpStatic(w, r)
 	})
 
-	http.HandleFunc("/assets/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/assets/", compressHandler(func(w http.ResponseWriter, r *http.Request) {
 		s.Increment("assets.hit")
 		defer s.NewTiming().Send("assets")
+		if httpNotModified(w, r) {
+			return
+		}
 		all_assets, err := assets()
 		if err != nil {
 			httpHandle500(w, err)
@@ -267,11 +383,14 @@ func web(port string) {
 			log.Print(err)
 			return
 		}
-	})
+	}))
 
-	http.HandleFunc("/tags/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/tags/", compressHandler(func(w http.ResponseWriter, r *http.Request) {
 		s.Increment("tags.hit")
 		defer s.NewTiming().Send("tags")
+		if httpNotModified(w, r) {
+			return
+		}
 		var formatted_tags string
 		formatted_tags, err := headHTML(1)
 		if err != nil {
@@ -290,17 +409,17 @@ func web(port string) {
 				return
 			}
 			tag_asset_count := len(assets)
-			formatted_tags += fmt.Sprintf("<div><a class=\"btn btn-outline-secondary\" href=\"../tag/%s\">%s <span class=\"badge badge-dark\">%d</span></a></div>\n", tag, tag, tag_asset_count)
+			formatted_tags += fmt.Sprintf("<div><a class=\"btn btn-outline-secondary\" href=\"../tag/%s\">%s <span class=\"badge badge-dark\">%d</span></a></div>\n", template.HTMLEscapeString(tag), template.HTMLEscapeString(tag), tag_asset_count)
 		}
-		formatted_tags += footerHTML
+		formatted_tags += footerHTML()
 		_, err = io.WriteString(w, formatted_tags)
 		if err != nil {
 			log.Print(err)
 			return
 		}
-	})
+	}))
 
-	http.HandleFunc("/tag/", func(w http.ResponseWriter, r *http.Request) {
+	tagHandler := compressHandler(func(w http.ResponseWriter, r *http.Request) {
 		s.Increment("tag.hit")
 		defer s.NewTiming().Send("tag")
 		path_parts := strings.Split(r.URL.Path, "/")
@@ -309,6 +428,9 @@ func web(port string) {
 			http.Error(w, ".'s not allowed.", http.StatusBadRequest)
 			return
 		}
+		if httpNotModified(w, r) {
+			return
+		}
 		tag_assets, err := assets_by_tag(tag)
 		if err != nil {
 			log.Print(err)
@@ -327,31 +449,65 @@ func web(port string) {
 		}
 	})
 
-	http.HandleFunc("/mime/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/tag/", func(w http.ResponseWriter, r *http.Request) {
+		path_parts := strings.Split(r.URL.Path, "/")
+		if len(path_parts) == 4 && path_parts[3] == "feed.atom" {
+			s.Increment("tag_feed.hit")
+			defer s.NewTiming().Send("tag_feed")
+			compressHandler(func(w http.ResponseWriter, r *http.Request) {
+				httpFeed(w, r, path_parts[2])
+			})(w, r)
+			return
+		}
+		if tag := path_parts[len(path_parts)-1]; strings.HasSuffix(tag, ".torrent") {
+			s.Increment("tag_torrent.hit")
+			defer s.NewTiming().Send("tag_torrent")
+			t, err := tagTorrent(strings.TrimSuffix(tag, ".torrent"), siteURL(r))
+			httpTorrent(w, r, t, err)
+			return
+		}
+		if tag, format, ok := splitArchiveName(path_parts[len(path_parts)-1]); ok {
+			s.Increment("tag_archive.hit")
+			defer s.NewTiming().Send("tag_archive")
+			httpTagArchive(w, r, tag, format)
+			return
+		}
+		tagHandler(w, r)
+	})
+
+	http.HandleFunc("/mime/", compressHandler(func(w http.ResponseWriter, r *http.Request) {
 		s.Increment("mime.hit")
 		defer s.NewTiming().Send("mime")
+		if httpNotModified(w, r) {
+			return
+		}
 		httpMimeType(w, r)
-	})
+	}))
 
-	http.HandleFunc("/mimes/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/mimes/", compressHandler(func(w http.ResponseWriter, r *http.Request) {
 		s.Increment("mimes.hit")
 		defer s.NewTiming().Send("mimes")
+		if httpNotModified(w, r) {
+			return
+		}
 		httpMimeTypes(w, r)
-	})
+	}))
 
-	http.HandleFunc("/info/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/info/", compressHandler(func(w http.ResponseWriter, r *http.Request) {
 		s.Increment("info.hit")
 		defer s.NewTiming().Send("info")
 		path_parts := strings.Split(r.URL.Path, "/")
-		asset := path_parts[len(path_parts)-1]
-		err = validateAsset(asset)
+		asset, err := resolveAsset(path_parts[len(path_parts)-1])
 		if err != nil {
 			log.Print(err.Error())
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if httpNotModified(w, r) {
+			return
+		}
 
-		info_html, err := infoHTML(asset)
+		info_html, err := infoHTML(asset, siteURL(r))
 		if err != nil {
 			httpHandle500(w, err)
 			return
@@ -361,15 +517,78 @@ func web(port string) {
 			log.Print(err)
 			return
 		}
+	}))
+
+	http.HandleFunc("/torrent/", func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("torrent.hit")
+		defer s.NewTiming().Send("torrent")
+		asset, err := resolveAsset(strings.TrimPrefix(r.URL.Path, "/torrent/"))
+		if err != nil {
+			httpHandle400(w, err)
+			return
+		}
+		t, err := assetTorrent(asset, siteURL(r))
+		httpTorrent(w, r, t, err)
+	})
+
+	http.HandleFunc("/cid/", func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("cid.hit")
+		defer s.NewTiming().Send("cid")
+		httpCID(w, r)
+	})
+
+	http.HandleFunc("/webseed/", func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("webseed.hit")
+		defer s.NewTiming().Send("webseed")
+		httpWebSeed(w, r)
+	})
+
+	http.HandleFunc("/manifest", func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("manifest.hit")
+		defer s.NewTiming().Send("manifest")
+		httpManifest(w, r, manifestPath(), "application/json")
 	})
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/manifest.sig", func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("manifest_sig.hit")
+		defer s.NewTiming().Send("manifest_sig")
+		httpManifest(w, r, manifestSignaturePath(), "text/plain; charset=utf-8")
+	})
+
+	http.HandleFunc("/replication", compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("replication.hit")
+		defer s.NewTiming().Send("replication")
+		httpReplication(w, r)
+	}))
+
+	http.HandleFunc("/changes", compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("changes.hit")
+		defer s.NewTiming().Send("changes")
+		httpChanges(w, r)
+	}))
+
+	http.HandleFunc("/peers", compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("peers.hit")
+		defer s.NewTiming().Send("peers")
+		httpPeers(w, r)
+	}))
+
+	http.HandleFunc("/feed.atom", compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		s.Increment("feed.hit")
+		defer s.NewTiming().Send("feed")
+		httpFeed(w, r, "")
+	}))
+
+	http.HandleFunc("/", compressHandler(func(w http.ResponseWriter, r *http.Request) {
 		s.Increment("index.hit")
 		defer s.NewTiming().Send("index")
 		if r.URL.Path != "/" {
 			http.Error(w, "Decensor endpoint does not exist.", http.StatusNotFound)
 			return
 		}
+		if httpNotModified(w, r) {
+			return
+		}
 		index_html, err := indexHTML()
 		if err != nil {
 			httpHandle500(w, err)
@@ -380,11 +599,31 @@ func web(port string) {
 			log.Print(err)
 			return
 		}
-	})
+	}))
+
+	// Sandboxed, we can't write to the store. `decensor receive` takes pushes and uploads instead.
+	if !inChroot {
+		registerReceiveHandlers(http.DefaultServeMux)
+	}
 
 	go statsdLoop(s)
 
-	log.Fatal(http.ListenAndServe(port, nil))
+	if interval := scrubInterval(); interval != 0 {
+		go scrubLoop(interval)
+	}
+
+	log.Fatal(http.ListenAndServe(port, lockedHandler(http.DefaultServeMux)))
+}
+
+// Everything but static files waits until an encrypted store is unlocked.
+func lockedHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if storeLocked() && !strings.HasPrefix(r.URL.Path, "/static/") {
+			http.Error(w, errStoreLocked.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
 }
 
 func httpHandle400(w http.ResponseWriter, err error) {
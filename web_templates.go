@@ -1,18 +1,78 @@
 package main
 
+import (
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Templates an operator can override with `decensor web <port> <template directory>`.
+// Anything missing from the directory falls back to the built in template.
+var builtinTemplates = map[string]string{
+	"head.html":   headHTMLTemplate,
+	"footer.html": footerHTMLTemplate,
+	"index.html":  indexHTMLTemplate,
+	"asset.html":  assetHTMLTemplate,
+}
+
+var overrideTemplates = make(map[string]string)
+
+func getTemplate(name string) string {
+	if override, ok := overrideTemplates[name]; ok {
+		return override
+	}
+	return builtinTemplates[name]
+}
+
+// This has to run before we chroot(), the directory is likely outside of baseDir().
+func loadTemplates(directory string) error {
+	stat, err := os.Stat(directory)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return errors.New("Template directory must be a directory.")
+	}
+	// Nothing is overridden unless everything parses.
+	overrides := make(map[string]string)
+	for name := range builtinTemplates {
+		path := filepath.Join(directory, name)
+		templateByte, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		// Catch syntax errors now rather than on every request.
+		if _, err = template.New(name).Parse(string(templateByte)); err != nil {
+			return err
+		}
+		overrides[name] = string(templateByte)
+	}
+	for name, override := range overrides {
+		log.Printf("Using %s from %s", name, directory)
+		overrideTemplates[name] = override
+	}
+	return nil
+}
+
 const headHTMLTemplate = `<!doctype html>
 <html lang="en">
 <head>
-<link href="{{.LinkPrefix}}asset/{{.CSSAsset}}" rel="stylesheet" />
+<link href="{{.LinkPrefix}}{{.CSSPath}}" rel="stylesheet" />
+<link href="{{.LinkPrefix}}feed.atom" rel="alternate" type="application/atom+xml" title="{{.SiteTitle}}" />
 <meta name="viewport" content="width=device-width, initial-scale=1.0">
-<title>Decensor</title>
+<title>{{.SiteTitle}}</title>
 </head>
 <body>
 <div class="container">
 <header>
 <div class="mt-2 mb-2">
-<h1><a href="{{.LinkPrefix}}">Decensor</a></h1>
-<p>Checksum-based file tracking and tagging</p>
+<h1><a href="{{.LinkPrefix}}">{{.SiteTitle}}</a></h1>
+<p>{{.SiteDescription}}</p>
 <a class="btn btn-outline-primary" href="{{.LinkPrefix}}assets/">All Assets <span class="badge badge-dark">{{.AssetCount}}</span></a>
 <a class="btn btn-outline-primary" href="{{.LinkPrefix}}tags/">All Tags <span class="badge badge-dark">{{.TagCount}}</span></a>
 <a class="btn btn-outline-primary" href="{{.LinkPrefix}}mimes/">By File Type</a>
@@ -22,48 +82,68 @@ const headHTMLTemplate = `<!doctype html>
 `
 
 type headHTMLTemplateArgs struct {
-	LinkPrefix string
-	CSSAsset   string
-	AssetCount int
-	TagCount   int
+	LinkPrefix      string
+	CSSPath         string
+	SiteTitle       string
+	SiteDescription string
+	AssetCount      int
+	TagCount        int
 }
 
-const footerHTML = `</article></div>
+const footerHTMLTemplate = `</article></div>
 </body>
 </html>`
 
+type footerHTMLTemplateArgs struct {
+	SiteTitle string
+	SourceURL string
+}
+
 const indexHTMLTemplate = `
 {{.Head}}
 <p>
-Decensor is written in <a target="_blank" href="https://golang.org/">Golang</a> and released into the <a target="_blank" href="asset/{{.LicenseAsset}}">public domain</a>. Source code is available on <a target="_blank" href="https://github.com/teran-mckinney/decensor">Github</a>.
+Decensor is written in <a target="_blank" href="https://golang.org/">Golang</a> and released into the <a target="_blank" href="{{.LicensePath}}">public domain</a>. Source code is available at <a target="_blank" href="{{.SourceURL}}">{{.SourceURL}}</a>.
 </p>
 {{.Footer}}
 `
 
+// Head and Footer are already rendered from our own templates, so they go in
+// as they are. Everything else is escaped.
 type indexHTMLTemplateArgs struct {
-	Head         string
-	Footer       string
-	LicenseAsset string
+	Head            template.HTML
+	Footer          template.HTML
+	SiteTitle       string
+	SiteDescription string
+	SourceURL       string
+	LicensePath     string
 }
 
 const assetHTMLTemplate = `
-<div class="card card-body"><h5><a href="../asset/{{.Asset}}">{{.Filename}}</a></h5><div class="mb-2">
+<div class="card card-body"><h5><a href="{{.LinkPrefix}}asset/{{.Asset}}">{{.Filename}}</a></h5><div class="mb-2">
 {{range $tag := .Tags}}
-<a class="btn btn-outline-secondary btn-sm{{if eq $.ActiveTag $tag}} active{{end}}" href="../tag/{{$tag}}">{{$tag}}</a>
+<a class="btn btn-outline-secondary btn-sm{{if eq $.ActiveTag $tag}} active{{end}}" href="{{$.LinkPrefix}}tag/{{$tag}}">{{$tag}}</a>
 {{end}}
-<a class="btn btn-outline-danger btn-sm{{if eq .ActiveTag "permalink"}} active{{end}}" href="../info/{{.Asset}}">Permalink</a>
+<a class="btn btn-outline-danger btn-sm{{if eq .ActiveTag "permalink"}} active{{end}}" href="{{.LinkPrefix}}info/{{.Asset}}">Permalink</a>
 </div>
 {{if eq .ActiveTag "permalink"}}
-<div class="small">Size: <code>{{.Size}}</code> bytes</div><div class="small">SHA256: <code>{{.Asset}}</code></div><div class="small">Mime Type: <code>{{.MimeType}}</code></div>
+<div class="small">Size: <code>{{.Size}}</code> bytes</div><div class="small">Mime Type: <code>{{.MimeType}}</code></div><div class="small">Multihash: <code>{{.Multihash}}</code></div><div class="small">SHA256: <code>{{.SHA256}}</code></div><div class="small">SHA1: <code>{{.SHA1}}</code></div><div class="small">MD5: <code>{{.MD5}}</code></div><div class="small">IPFS CID: <code>{{.CID}}</code></div>
+{{range .Publishers}}<div class="small">Attested by: {{.}}</div>{{end}}
 {{end}}
 </div>
 `
 
 type assetHTMLTemplateArgs struct {
-	Asset     string
-	Filename  string
-	Tags      []string
-	ActiveTag string
-	Size      int64
-	MimeType  string
+	LinkPrefix string
+	Asset      string
+	Filename   string
+	Tags       []string
+	ActiveTag  string
+	Size       int64
+	MimeType   string
+	CID        string
+	Multihash  string
+	SHA256     string
+	SHA1       string
+	MD5        string
+	Publishers []string
 }
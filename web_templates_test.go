@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestLoadTemplates(t *testing.T) {
+	defer func() { overrideTemplates = make(map[string]string) }()
+	directory := t.TempDir()
+	if err := ioutil.WriteFile(directory+"/footer.html", []byte("<footer>Custom</footer>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTemplates(directory); err != nil {
+		t.Fatal(err)
+	}
+	if getTemplate("footer.html") != "<footer>Custom</footer>" {
+		t.Errorf("footer.html should be overridden, got %q", getTemplate("footer.html"))
+	}
+	// Missing from the directory, so the built in one.
+	if getTemplate("head.html") != headHTMLTemplate {
+		t.Errorf("head.html should fall back to the built in template")
+	}
+
+	overrideTemplates = make(map[string]string)
+	if err := ioutil.WriteFile(directory+"/asset.html", []byte("{{.Asset"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTemplates(directory); err == nil {
+		t.Errorf("A malformed template should fail to load")
+	}
+	if len(overrideTemplates) != 0 {
+		t.Errorf("Nothing should be overridden if a template is malformed, got %v", overrideTemplates)
+	}
+
+	if err := loadTemplates(directory + "/footer.html"); err == nil {
+		t.Errorf("A file is not a template directory")
+	}
+}
+
+func TestAssetHTMLEscapes(t *testing.T) {
+	// Filenames and tags come from mirrors, pushes and uploads.
+	asset := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	output, err := assetHTML(asset, "<script>alert(1)</script>", []string{"\"><b>tag</b>"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output, "<script>") || strings.Contains(output, "<b>") {
+		t.Errorf("Filename and tags should be escaped, got %s", output)
+	}
+	if !strings.Contains(output, "&lt;script&gt;") {
+		t.Errorf("Filename should still be shown, got %s", output)
+	}
+}